@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 
@@ -10,12 +11,51 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
 )
 
+// collects repeated -route flags
+type routeFlags []proxy.Route
+
+func (r *routeFlags) String() string {
+	specs := []string{}
+	for _, route := range *r {
+		specs = append(specs, route.Host+route.PathPrefix+"="+route.Target)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (r *routeFlags) Set(spec string) error {
+	route, err := proxy.ParseRoute(spec)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, route)
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "har-import":
+			harImport(os.Args[2:])
+			return
+		case "har-export":
+			harExport(os.Args[2:])
+			return
+		}
+	}
+
 	cassetteDirectory := flag.String("cassete-directory", "./cassettes", "directory when recorded interactions are written")
 	port := flag.Int("port", 8080, "port for proxy to listen on")
 	target := flag.String("target-url", "", "remote target url to proxy requests to")
+	forward := flag.Bool("forward-proxy", false, "act as a forward proxy for clients using HTTP_PROXY and HTTPS_PROXY instead of proxying to -target-url")
+	caDirectory := flag.String("ca-directory", "./ca", "directory where the CA certificate for intercepting HTTPS traffic is kept")
+	var routes routeFlags
+	flag.Var(&routes, "route", "additional target as <host>=<url> or </path prefix>=<url>; may be repeated")
 
 	flag.Parse()
 
@@ -25,6 +65,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *forward {
+		ca, err := proxy.LoadOrCreateCA(*caDirectory)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("betamax forward proxy listening on 0.0.0.0:%d, clients must trust %s\n", *port, path.Join(*caDirectory, proxy.CACertificateFile))
+		serve(listener, proxy.ForwardProxy(*cassetteDirectory, ca, nil))
+		return
+	}
+
 	if *target == "" {
 		fmt.Println("No target url given.")
 		flag.Usage()
@@ -37,8 +89,32 @@ func main() {
 		os.Exit(1)
 	}
 
-	proxy := proxy.Proxy(targetUrl, *cassetteDirectory)
+	proxy := proxy.Proxy(targetUrl, *cassetteDirectory, routes...)
 
 	fmt.Printf("betamax server proxy to %s listening on 0.0.0.0:%d\n", targetUrl, *port)
-	http.Serve(listener, proxy)
+	serve(listener, proxy)
+}
+
+// serves handler until SIGINT or SIGTERM, then lets requests in flight
+// finish and writes the episodes still batched before returning
+func serve(listener net.Listener, handler http.Handler) {
+	server := &http.Server{Handler: handler}
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		server.Shutdown(context.Background())
+		close(stopped)
+	}()
+
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	<-stopped
+	if err := proxy.Flush(handler); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/thegreatape/betamax/proxy"
+)
+
+// betamax har-import [flags] <file.har> <cassette>
+func harImport(args []string) {
+	flags := flag.NewFlagSet("har-import", flag.ExitOnError)
+	cassetteDirectory := flags.String("cassete-directory", "./cassettes", "directory when recorded interactions are written")
+	format := flags.String("cassette-format", proxy.FormatJSON, "format of the written cassette: json, vcr_yaml or har")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: betamax har-import [flags] <file.har> <cassette>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var har proxy.HAR
+	if err := json.Unmarshal(data, &har); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cassette, err := proxy.HARToCassette(flags.Arg(1), &har)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	config := proxy.Config{
+		Cassette:       cassette.Name,
+		CassetteDir:    *cassetteDirectory,
+		CassetteFormat: *format,
+		Episodes:       cassette.Episodes,
+	}
+	if err := config.Save(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("imported %d episodes into cassette %s\n", len(cassette.Episodes), cassette.Name)
+}
+
+// betamax har-export [flags] <cassette> [file.har]
+func harExport(args []string) {
+	flags := flag.NewFlagSet("har-export", flag.ExitOnError)
+	cassetteDirectory := flags.String("cassete-directory", "./cassettes", "directory when recorded interactions are written")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: betamax har-export [flags] <cassette> [file.har]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	config := proxy.Config{Cassette: flags.Arg(0), CassetteDir: *cassetteDirectory}
+	if err := config.Load(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	har := proxy.CassetteToHAR(proxy.Cassette{Name: config.Cassette, Episodes: config.Episodes})
+	data, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if flags.NArg() == 1 {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := ioutil.WriteFile(flags.Arg(1), data, 0644); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+)
+
+// Bodies larger than the config's BlobThreshold are kept out of the
+// cassette, in side-car files in a <cassette>.blobs directory next to it.
+// The files are named after the SHA-256 of their contents, which is what
+// the body matcher compares for them, and are streamed through instead of
+// being held in memory. They are stored as sent, so they are neither
+// decoded nor redacted; while bodies are redacted, no blobs are written.
+
+// the body size above which bodies are spooled to blob files, or zero if
+// they never are
+func (c *Config) blobThreshold() int64 {
+	if c.Redact.redactsBodies() {
+		return 0
+	}
+	return c.BlobThreshold
+}
+
+func (c *Config) blobDir() string {
+	return path.Join(c.CassetteDir, c.Cassette+".blobs")
+}
+
+func (c *Config) blobPath(name string) string {
+	return path.Join(c.blobDir(), name)
+}
+
+// writes a body to a temporary file in the blob directory, hashing it on
+// the way, until it is committed under its name or discarded
+type blobWriter struct {
+	dir  string
+	file *os.File
+	hash hash.Hash
+}
+
+func newBlobWriter(dir string) (*blobWriter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{dir: dir, file: file, hash: sha256.New()}, nil
+}
+
+func (b *blobWriter) Write(data []byte) (int, error) {
+	n, err := b.file.Write(data)
+	b.hash.Write(data[:n])
+	return n, err
+}
+
+func (b *blobWriter) name() string {
+	return hex.EncodeToString(b.hash.Sum(nil))
+}
+
+// moves the blob into place and returns its name
+func (b *blobWriter) commit() (string, error) {
+	name := b.name()
+	if err := b.file.Close(); err != nil {
+		os.Remove(b.file.Name())
+		return "", err
+	}
+	if err := os.Rename(b.file.Name(), path.Join(b.dir, name)); err != nil {
+		os.Remove(b.file.Name())
+		return "", err
+	}
+	return name, nil
+}
+
+// removes the blob unless it was committed
+func (b *blobWriter) discard() {
+	b.file.Close()
+	os.Remove(b.file.Name())
+}
+
+type spooledBodyKey struct{}
+
+// a request body too large to keep in memory, spooled to a blob file
+type spooledBody struct {
+	blob *blobWriter
+	name string
+}
+
+// moves request bodies larger than the blob threshold to a blob file, and
+// serves the request's body from there. smaller bodies are read into
+// memory as usual. the returned body, if any, must be discarded once the
+// request is done.
+func spoolRequestBody(req *http.Request, config *Config) (*http.Request, *spooledBody, error) {
+	if req.Body == nil {
+		return req, nil, nil
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(req.Body, config.blobThreshold()+1))
+	if err != nil {
+		return req, nil, err
+	}
+	if int64(len(head)) <= config.blobThreshold() {
+		req.Body = ioutil.NopCloser(bytes.NewReader(head))
+		return req, nil, nil
+	}
+
+	blob, err := newBlobWriter(config.blobDir())
+	if err != nil {
+		return req, nil, err
+	}
+	if _, err := blob.Write(head); err != nil {
+		blob.discard()
+		return req, nil, err
+	}
+	if _, err := io.Copy(blob, req.Body); err != nil {
+		blob.discard()
+		return req, nil, err
+	}
+	if _, err := blob.file.Seek(0, io.SeekStart); err != nil {
+		blob.discard()
+		return req, nil, err
+	}
+
+	spooled := &spooledBody{blob: blob, name: blob.name()}
+	req = withSpooledBody(req, spooled)
+	req.Body = ioutil.NopCloser(blob.file)
+	return req, spooled, nil
+}
+
+func withSpooledBody(req *http.Request, spooled *spooledBody) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), spooledBodyKey{}, spooled))
+}
+
+// the spooled body of req, or nil if its body is in memory
+func requestSpooledBody(req *http.Request) *spooledBody {
+	spooled, _ := req.Context().Value(spooledBodyKey{}).(*spooledBody)
+	return spooled
+}
+
+// the name of the blob holding the body of req, empty if it has none
+func requestBlob(req *http.Request) string {
+	if spooled := requestSpooledBody(req); spooled != nil {
+		return spooled.name
+	}
+	return ""
+}
@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const cassettesPath = "/__betamax__/cassettes"
+
+// CassetteInfo describes a cassette file in the cassette directory.
+type CassetteInfo struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+}
+
+// serves the cassette management API:
+//
+//	GET    /__betamax__/cassettes                          lists the cassettes
+//	GET    /__betamax__/cassettes/<name>                   the cassette as JSON
+//	PUT    /__betamax__/cassettes/<name>                   replaces the cassette with the JSON body
+//	DELETE /__betamax__/cassettes/<name>                   deletes the cassette and its blobs
+//	GET    /__betamax__/cassettes/<name>/episodes          lists the episodes
+//	GET    /__betamax__/cassettes/<name>/episodes/<index>  one episode
+//	DELETE /__betamax__/cassettes/<name>/episodes/<index>  deletes one episode
+//
+// changes to the inserted cassette take effect right away.
+func handleCassettesRequest(resp http.ResponseWriter, req *http.Request, store *store) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, cassettesPath), "/"), "/")
+	if parts[0] == "" {
+		if req.Method != "GET" {
+			jsonError(resp, "method not allowed", 405)
+			return
+		}
+		cassettes, err := listCassettes(store.Config().CassetteDir)
+		if err != nil {
+			jsonError(resp, err.Error(), 500)
+			return
+		}
+		writeJSON(resp, cassettes)
+		return
+	}
+
+	name := parts[0]
+	if err := validateCassetteName(name); err != nil {
+		jsonError(resp, err.Error(), 400)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		handleCassetteRequest(resp, req, store, name)
+	case len(parts) == 2 && parts[1] == "episodes":
+		handleEpisodesRequest(resp, req, store, name, -1)
+	case len(parts) == 3 && parts[1] == "episodes":
+		index, err := strconv.Atoi(parts[2])
+		if err != nil || index < 0 {
+			jsonError(resp, fmt.Sprintf("episode index %q is not a number", parts[2]), 400)
+			return
+		}
+		handleEpisodesRequest(resp, req, store, name, index)
+	default:
+		jsonError(resp, "not found", 404)
+	}
+}
+
+func handleCassetteRequest(resp http.ResponseWriter, req *http.Request, store *store, name string) {
+	switch req.Method {
+	case "GET":
+		cassette, status, err := readCassetteForAPI(store, name)
+		if err != nil {
+			jsonError(resp, err.Error(), status)
+			return
+		}
+		data, err := jsonFormat{}.Marshal(Cassette{Name: name, TargetURL: cassette.TargetURL, Episodes: cassette.Episodes})
+		if err != nil {
+			jsonError(resp, err.Error(), 500)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(data)
+	case "PUT":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			jsonError(resp, err.Error(), 400)
+			return
+		}
+		uploaded, err := jsonFormat{}.Unmarshal(body)
+		if err != nil {
+			jsonError(resp, fmt.Sprintf("cassette is not valid: %s", err), 400)
+			return
+		}
+		err = modifyCassette(store, name, func(cassette *Config) error {
+			// the cassette is written in the configured format only. the new
+			// file replaces the old one before the files in other formats are
+			// removed, so the cassette is never lost halfway.
+			cassette.Episodes = uploaded.Episodes
+			if err := cassette.Save(); err != nil {
+				return err
+			}
+			_, err := removeCassetteFiles(cassette, cassette.cassettePath(), false)
+			return err
+		})
+		if err != nil {
+			jsonError(resp, err.Error(), 500)
+			return
+		}
+		writeJSON(resp, map[string]interface{}{"name": name, "episodes": len(uploaded.Episodes)})
+	case "DELETE":
+		status := 500
+		err := modifyCassette(store, name, func(cassette *Config) error {
+			removed, err := removeCassetteFiles(cassette, "", true)
+			if err == nil && !removed {
+				status = 404
+				err = fmt.Errorf("no cassette %q", name)
+			}
+			return err
+		})
+		if err != nil {
+			jsonError(resp, err.Error(), status)
+			return
+		}
+		resp.WriteHeader(204)
+	default:
+		jsonError(resp, "method not allowed", 405)
+	}
+}
+
+// index is -1 for the list of all episodes
+func handleEpisodesRequest(resp http.ResponseWriter, req *http.Request, store *store, name string, index int) {
+	switch req.Method {
+	case "GET":
+		cassette, status, err := readCassetteForAPI(store, name)
+		if err != nil {
+			jsonError(resp, err.Error(), status)
+			return
+		}
+		if index < 0 {
+			writeJSON(resp, writeableEpisodes(cassette.Episodes))
+			return
+		}
+		if index >= len(cassette.Episodes) {
+			jsonError(resp, fmt.Sprintf("cassette %q has no episode %d", name, index), 404)
+			return
+		}
+		writeJSON(resp, writeableEpisodes(cassette.Episodes[index : index+1])[0])
+	case "DELETE":
+		if index < 0 {
+			jsonError(resp, "method not allowed", 405)
+			return
+		}
+		status := 500
+		err := modifyCassette(store, name, func(cassette *Config) error {
+			if err := cassette.Load(); err != nil {
+				if os.IsNotExist(err) {
+					status = 404
+				}
+				return err
+			}
+			if index >= len(cassette.Episodes) {
+				status = 404
+				return fmt.Errorf("cassette %q has no episode %d", name, index)
+			}
+			episodes := append([]Episode{}, cassette.Episodes[:index]...)
+			cassette.Episodes = append(episodes, cassette.Episodes[index+1:]...)
+			return cassette.Save()
+		})
+		if err != nil {
+			jsonError(resp, err.Error(), status)
+			return
+		}
+		resp.WriteHeader(204)
+	default:
+		jsonError(resp, "method not allowed", 405)
+	}
+}
+
+func writeJSON(resp http.ResponseWriter, value interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(value)
+}
+
+// cassette names become file names in the cassette directory, so they
+// must not point anywhere else
+func validateCassetteName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid cassette name %q", name)
+	}
+	return nil
+}
+
+// the configuration for reading and writing another cassette in the same
+// directory and format
+func (c *Config) forCassette(name string) *Config {
+	return &Config{
+		Cassette:       name,
+		CassetteDir:    c.CassetteDir,
+		CassetteFormat: c.CassetteFormat,
+		TargetURL:      c.TargetURL,
+	}
+}
+
+// loads a cassette from disk, after writing pending episodes so the
+// inserted cassette is read in full. returns the status to answer with if
+// loading failed.
+func readCassetteForAPI(store *store, name string) (*Config, int, error) {
+	if err := store.Flush(); err != nil {
+		return nil, 500, err
+	}
+	cassette := store.Config().forCassette(name)
+	if err := cassette.Load(); err != nil {
+		if os.IsNotExist(err) {
+			return nil, 404, fmt.Errorf("no cassette %q", name)
+		}
+		return nil, 500, err
+	}
+	return cassette, 200, nil
+}
+
+// applies fn to the named cassette. changes are serialized with recording
+// and config updates, and the inserted cassette is reloaded if it is the
+// one changed.
+func modifyCassette(store *store, name string, fn func(cassette *Config) error) error {
+	return store.update(func(config *Config) error {
+		if err := fn(config.forCassette(name)); err != nil {
+			return err
+		}
+		if config.Cassette != name {
+			return nil
+		}
+		// episode indexes have changed, so ordered playback starts over
+		config.rewind = true
+		if err := config.Load(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// removes the files of a cassette in every format, except the file keep,
+// and its blobs if withBlobs is set. reports whether there was a cassette
+// file to remove.
+func removeCassetteFiles(cassette *Config, keep string, withBlobs bool) (removed bool, err error) {
+	if _, err := os.Stat(cassette.CassetteDir); os.IsNotExist(err) {
+		return false, nil
+	}
+	unlock, err := lockDir(cassette.CassetteDir, true)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	for _, name := range formatNames(FormatJSON) {
+		format, err := lookupCassetteFormat(name)
+		if err != nil {
+			continue
+		}
+		for _, ext := range format.Extensions() {
+			filename := path.Join(cassette.CassetteDir, cassette.Cassette+ext)
+			if filename == keep {
+				continue
+			}
+			err := os.Remove(filename)
+			if err == nil {
+				removed = true
+			} else if !os.IsNotExist(err) {
+				return removed, err
+			}
+		}
+	}
+	if withBlobs {
+		return removed, os.RemoveAll(cassette.blobDir())
+	}
+	return removed, nil
+}
+
+// the cassettes in dir, by the extensions of the registered formats
+func listCassettes(dir string) ([]CassetteInfo, error) {
+	extensions := map[string]string{}
+	for _, name := range formatNames(FormatJSON) {
+		if format, err := lookupCassetteFormat(name); err == nil {
+			for _, ext := range format.Extensions() {
+				if _, taken := extensions[ext]; !taken {
+					extensions[ext] = name
+				}
+			}
+		}
+	}
+
+	cassettes := []CassetteInfo{}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return cassettes, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		ext := path.Ext(file.Name())
+		if format, ok := extensions[ext]; ok {
+			cassettes = append(cassettes, CassetteInfo{Name: strings.TrimSuffix(file.Name(), ext), Format: format})
+		}
+	}
+	sort.Slice(cassettes, func(i, j int) bool {
+		return cassettes[i].Name < cassettes[j].Name
+	})
+	return cassettes, nil
+}
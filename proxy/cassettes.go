@@ -1,30 +1,101 @@
 package proxy
 
 import (
+	"bytes"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 )
 
+// Version is the betamax version written into cassettes.
+const Version = "0.2.0"
+
 type Cassette struct {
-	Name     string
-	Episodes []Episode
+	Name string
+	// the proxy's default target when the cassette was written
+	TargetURL string
+	Episodes  []Episode
 }
 
 type Episode struct {
 	Request  RecordedRequest
 	Response RecordedResponse
+	// when the request was sent upstream and how long the round trip took;
+	// zero for episodes from cassettes that did not keep track
+	RecordedAt time.Time
+	Duration   time.Duration
+	// the messages of a WebSocket connection, in the order they were sent
+	WebSocketMessages []WebSocketMessage
 }
 
 type RecordedRequest struct {
+	// name of the route the request was sent through, empty for the
+	// proxy's default target
+	Target string
 	Method string
+	Host   string
 	URL    *url.URL
 	Header http.Header
 	Body   []byte
 	Form   map[string][]string
+	// name of the blob file holding the body instead of Body, if it was
+	// too large to keep in the cassette
+	BodyBlob string
 }
 
 type RecordedResponse struct {
 	StatusCode int
 	Body       []byte
 	Header     http.Header
+	// name of the blob file holding the body instead of Body, if it was
+	// too large to keep in the cassette
+	BodyBlob string
+	// how the body was flushed to the client, if it was streamed
+	Chunks []Chunk
+	// the Content-Encoding the body was served with; the recorded body is
+	// stored decoded and compressed again on replay
+	ContentEncoding string
+}
+
+// Chunk is a part of a streamed response body as it was flushed to the
+// client, so streams like server-sent events can be replayed with their
+// original timing.
+type Chunk struct {
+	// number of body bytes in the chunk
+	Size int
+	// time from sending the response headers to flushing the chunk
+	Elapsed time.Duration
+}
+
+// rebuilds an http.Request from the recording, so recorded requests can be
+// compared with the same matching rules as live ones
+func (r *RecordedRequest) httpRequest() *http.Request {
+	req := &http.Request{
+		Method: r.Method,
+		Host:   r.Host,
+		URL:    r.URL,
+		Header: r.Header,
+		Body:   ioutil.NopCloser(bytes.NewReader(r.Body)),
+	}
+	if r.Target != "" {
+		req = withRoute(req, &Route{Name: r.Target})
+	}
+	return req
+}
+
+// the URL the request was sent to. requests to the reverse proxy only
+// carry a path, with the host kept separately.
+func (r *RecordedRequest) absoluteURL() string {
+	uri := url.URL{}
+	if r.URL != nil {
+		uri = *r.URL
+	}
+	if uri.Host == "" {
+		uri.Host = r.Host
+	}
+	if uri.Scheme == "" {
+		uri.Scheme = "http"
+	}
+	return uri.String()
 }
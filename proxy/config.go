@@ -1,47 +1,309 @@
 package proxy
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"reflect"
 	"regexp"
+	"strings"
+	"time"
 )
 
+// RecordMode controls whether the proxy replays recorded episodes,
+// records new ones, or refuses requests it has no recording for.
+// The modes mirror the ones from Ruby's VCR.
+type RecordMode string
+
+const (
+	// replay recorded episodes; record only if the cassette did not
+	// exist yet, otherwise refuse unrecorded requests
+	RecordOnce RecordMode = "once"
+	// replay recorded episodes and record anything new
+	RecordNewEpisodes RecordMode = "new_episodes"
+	// replay recorded episodes and refuse anything new
+	RecordNone RecordMode = "none"
+	// never replay; proxy and record every request
+	RecordAll RecordMode = "all"
+)
+
+func (m RecordMode) Valid() bool {
+	switch m {
+	case RecordOnce, RecordNewEpisodes, RecordNone, RecordAll:
+		return true
+	}
+	return false
+}
+
+// PlaybackPolicy decides what ordered playback does for a request once
+// every episode matching it has been played and the record mode does not
+// allow recording a new one.
+type PlaybackPolicy string
+
+const (
+	// keep replaying the last matching episode
+	PlaybackRepeatLast PlaybackPolicy = "repeat_last"
+	// start over with the first matching episode
+	PlaybackCycle PlaybackPolicy = "cycle"
+	// refuse the request like an unrecorded one
+	PlaybackFail PlaybackPolicy = "fail"
+)
+
+func (p PlaybackPolicy) Valid() bool {
+	switch p {
+	case PlaybackRepeatLast, PlaybackCycle, PlaybackFail:
+		return true
+	}
+	return false
+}
+
 type Config struct {
-	TargetHost             string
-	CassetteDir            string
-	Episodes               []Episode
-	Cassette               string   `json:"cassette"`
-	RecordNewEpisodes      bool     `json:"record_new_episodes"`
-	DenyUnrecordedRequests bool     `json:"deny_unrecorded_requests"`
-	RewriteHostHeader      bool     `json:"rewrite_host_header"`
-	MatchHeaders           []string `json:"match_headers"`
+	// set up by the proxy, and neither shown nor changed over http
+	TargetURL   string    `json:"-"`
+	TargetHost  string    `json:"-"`
+	CassetteDir string    `json:"-"`
+	Episodes    []Episode `json:"-"`
+
+	Cassette          string     `json:"cassette"`
+	RecordMode        RecordMode `json:"record_mode"`
+	RewriteHostHeader bool       `json:"rewrite_host_header"`
+	MatchHeaders      []string   `json:"match_headers"`
+	// names of the matchers a request has to pass to replay an episode;
+	// DefaultMatchOn if empty
+	MatchOn []string `json:"match_on"`
+	// query parameters the query matcher ignores, like cache busters
+	IgnoreQueryParams []string `json:"ignore_query_params"`
+	// if set, the only query parameters the query matcher compares
+	MatchQueryParams []string `json:"match_query_params"`
+	// JSONPath-style expressions for volatile fields, like timestamps or
+	// nonces, that the json_body matcher ignores
+	IgnoreJSONPaths []string `json:"ignore_json_paths"`
+	// upstreams other than the default target, picked by host or path prefix
+	Routes []Route `json:"routes"`
+	// secrets replaced with a placeholder before episodes are stored
+	Redact Redactions `json:"redact"`
+	// how new cassettes are written, FormatJSON if empty; existing
+	// cassettes keep the format they were found in
+	CassetteFormat string `json:"cassette_format"`
+	// how long recorded episodes are batched before the cassette is written
+	// to disk; zero writes the cassette after every recorded episode
+	FlushInterval int `json:"flush_interval_ms"`
+	// replay the episodes matching a request one after the other, in the
+	// order they were recorded, instead of always the first one
+	OrderedPlayback   bool           `json:"ordered_playback"`
+	PlaybackExhausted PlaybackPolicy `json:"playback_exhausted"`
+	// seconds after which a recorded episode is stale and recorded again
+	// when it is requested, as long as the upstream can be reached; zero
+	// keeps episodes forever
+	ReRecordInterval int `json:"re_record_interval"`
+	// delays applied to replayed episodes; the first of the latency rules
+	// matching the request URL is used instead of the global latency
+	Latency      Latency       `json:"latency"`
+	LatencyRules []LatencyRule `json:"latency_rules"`
+	// how much faster than recorded streamed responses are replayed; 2
+	// replays them twice as fast. 1 if unset.
+	ReplaySpeed float64 `json:"replay_speed"`
+	// failures injected into matching requests before they are replayed
+	// or proxied
+	Faults []FaultRule `json:"faults"`
+	// bodies larger than this many bytes are streamed to side-car files
+	// next to the cassette instead of being kept in memory and in the
+	// cassette; zero keeps every body in the cassette, and so do body
+	// redactions, which blobs would escape
+	BlobThreshold int64 `json:"blob_threshold_bytes"`
+
+	// whether the current cassette already existed on disk when it was loaded;
+	// used by RecordOnce to decide between recording and refusing.
+	cassetteExisted bool
+	// set by a config update asking to start ordered playback over
+	rewind bool
+	// the format the current cassette was found in on disk, which it is
+	// read and written in instead of CassetteFormat
+	foundFormat string
+}
+
+// UnmarshalJSON decodes a config payload on top of the existing values, so
+// partial updates leave unspecified settings alone. The legacy
+// record_new_episodes and deny_unrecorded_requests flags are still accepted
+// and mapped onto the equivalent record mode. "rewind": true starts
+// ordered playback over from the first episode. Unknown fields and values
+// of the wrong type are errors.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plainConfig Config
+	payload := struct {
+		*plainConfig
+		RecordNewEpisodes      *bool `json:"record_new_episodes"`
+		DenyUnrecordedRequests *bool `json:"deny_unrecorded_requests"`
+		Rewind                 bool  `json:"rewind"`
+	}{plainConfig: (*plainConfig)(c)}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&payload); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			// the field path starts with the name of the payload struct
+			field := strings.TrimPrefix(typeErr.Field, "plainConfig.")
+			return fmt.Errorf("%s must be %s, not %s", field, jsonTypeName(typeErr.Type), typeErr.Value)
+		}
+		return err
+	}
+	c.rewind = payload.Rewind
+
+	if c.Cassette != "" {
+		if err := validateCassetteName(c.Cassette); err != nil {
+			return err
+		}
+	}
+
+	deny := payload.DenyUnrecordedRequests
+	record := payload.RecordNewEpisodes
+	switch {
+	case deny != nil && *deny:
+		c.RecordMode = RecordNone
+	case record != nil && !*record:
+		// the old flags never replayed anything with record_new_episodes
+		// unset, which is exactly what RecordAll does
+		c.RecordMode = RecordAll
+	case record != nil, deny != nil && c.RecordMode == RecordNone:
+		c.RecordMode = RecordNewEpisodes
+	}
+
+	if c.RecordMode == "" {
+		c.RecordMode = RecordNewEpisodes
+	}
+	if !c.RecordMode.Valid() {
+		return fmt.Errorf("unknown record mode %q", c.RecordMode)
+	}
+
+	for _, name := range c.MatchOn {
+		if _, err := lookupMatcher(name); err != nil {
+			return err
+		}
+	}
+	if _, err := lookupCassetteFormat(c.CassetteFormat); err != nil {
+		return err
+	}
+	if c.ReRecordInterval < 0 {
+		return fmt.Errorf("re_record_interval must not be negative")
+	}
+	if c.BlobThreshold < 0 {
+		return fmt.Errorf("blob_threshold_bytes must not be negative")
+	}
+	if c.ReplaySpeed < 0 {
+		return fmt.Errorf("replay_speed must not be negative")
+	}
+	if err := c.Latency.validate(); err != nil {
+		return err
+	}
+	for i := range c.LatencyRules {
+		if err := c.LatencyRules[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range c.Faults {
+		if err := c.Faults[i].normalize(); err != nil {
+			return err
+		}
+	}
+	for _, expr := range c.IgnoreJSONPaths {
+		if _, err := parseJSONPath(expr); err != nil {
+			return err
+		}
+	}
+	if err := c.Redact.validate(); err != nil {
+		return err
+	}
+	for i := range c.Routes {
+		if err := c.Routes[i].normalize(); err != nil {
+			return err
+		}
+	}
+
+	if c.PlaybackExhausted == "" {
+		c.PlaybackExhausted = PlaybackRepeatLast
+	}
+	if !c.PlaybackExhausted.Valid() {
+		return fmt.Errorf("unknown playback policy %q", c.PlaybackExhausted)
+	}
+	return nil
+}
+
+// how a Go type is written in JSON, for error messages
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// the JSON cassette file: the episodes and what they were recorded with
+type WriteableCassette struct {
+	FormatVersion  int                `json:"format_version"`
+	BetamaxVersion string             `json:"betamax_version"`
+	TargetURL      string             `json:"target_url,omitempty"`
+	Episodes       []WriteableEpisode `json:"episodes"`
 }
 
 type WriteableEpisode struct {
-	Request  WriteableRecordedRequest
-	Response WriteableRecordedResponse
+	Request    WriteableRecordedRequest
+	Response   WriteableRecordedResponse
+	RecordedAt *time.Time `json:",omitempty"`
+	// round trip time as a Go duration string, like "120.5ms"
+	Duration          string                      `json:",omitempty"`
+	WebSocketMessages []WriteableWebSocketMessage `json:",omitempty"`
 }
 
 // proxy structs with interface{} instead of []byte
 // for bodies so we can write plain text as human-readable
 // strings but still store binary
 type WriteableRecordedRequest struct {
-	Method string
-	URL    *url.URL
-	Header http.Header
-	Body   interface{}
-	Form   map[string][]string
+	Target   string `json:",omitempty"`
+	Method   string
+	Host     string
+	URL      *url.URL
+	Header   http.Header
+	Body     interface{}
+	Form     map[string][]string
+	BodyBlob string `json:",omitempty"`
 }
 
 type WriteableRecordedResponse struct {
-	StatusCode int
-	Body       interface{}
-	Header     http.Header
+	StatusCode      int
+	Body            interface{}
+	Header          http.Header
+	ContentEncoding string           `json:",omitempty"`
+	BodyBlob        string           `json:",omitempty"`
+	Chunks          []WriteableChunk `json:",omitempty"`
+}
+
+type WriteableChunk struct {
+	Size int
+	// time since the headers as a Go duration string, like "1.5s"
+	Elapsed string
+}
+
+// text messages are written as strings, binary ones base64 encoded
+type WriteableWebSocketMessage struct {
+	From   string
+	Binary bool `json:",omitempty"`
+	Data   interface{}
+	// time since the handshake as a Go duration string
+	Elapsed string
 }
 
 func IsText(headers http.Header) bool {
@@ -53,6 +315,15 @@ func IsText(headers http.Header) bool {
 	return matched
 }
 
+func IsJSON(headers http.Header) bool {
+	contentType := headers["Content-Type"]
+	if contentType == nil {
+		return false
+	}
+	matched, _ := regexp.Match("json", []byte(contentType[0]))
+	return matched
+}
+
 func writableBodyForContentType(body []byte, headers http.Header) interface{} {
 	if IsText(headers) {
 		return string(body)
@@ -62,10 +333,12 @@ func writableBodyForContentType(body []byte, headers http.Header) interface{} {
 }
 
 func bodyForContentType(body interface{}, headers http.Header) []byte {
+	// empty bodies are written as null
+	encoded, _ := body.(string)
 	if IsText(headers) {
-		return []byte(body.(string))
+		return []byte(encoded)
 	} else {
-		str, _ := base64.StdEncoding.DecodeString(body.(string))
+		str, _ := base64.StdEncoding.DecodeString(encoded)
 		return []byte(str)
 	}
 }
@@ -74,23 +347,50 @@ func writeableEpisodes(episodes []Episode) []WriteableEpisode {
 	writeables := make([]WriteableEpisode, len(episodes))
 	for i, episode := range episodes {
 		request := WriteableRecordedRequest{
-			Method: episode.Request.Method,
-			URL:    episode.Request.URL,
-			Header: episode.Request.Header,
-			Body:   writableBodyForContentType(episode.Request.Body, episode.Request.Header),
-			Form:   episode.Request.Form,
+			Target:   episode.Request.Target,
+			Method:   episode.Request.Method,
+			Host:     episode.Request.Host,
+			URL:      episode.Request.URL,
+			Header:   episode.Request.Header,
+			Body:     writableBodyForContentType(episode.Request.Body, episode.Request.Header),
+			Form:     episode.Request.Form,
+			BodyBlob: episode.Request.BodyBlob,
 		}
 
 		response := WriteableRecordedResponse{
-			StatusCode: episode.Response.StatusCode,
-			Header:     episode.Response.Header,
-			Body:       writableBodyForContentType(episode.Response.Body, episode.Response.Header),
+			StatusCode:      episode.Response.StatusCode,
+			Header:          episode.Response.Header,
+			Body:            writableBodyForContentType(episode.Response.Body, episode.Response.Header),
+			ContentEncoding: episode.Response.ContentEncoding,
+			BodyBlob:        episode.Response.BodyBlob,
+		}
+		for _, chunk := range episode.Response.Chunks {
+			response.Chunks = append(response.Chunks, WriteableChunk{Size: chunk.Size, Elapsed: chunk.Elapsed.String()})
 		}
 
 		writeable := WriteableEpisode{
 			Request:  request,
 			Response: response,
 		}
+		if !episode.RecordedAt.IsZero() {
+			recordedAt := episode.RecordedAt
+			writeable.RecordedAt = &recordedAt
+		}
+		if episode.Duration != 0 {
+			writeable.Duration = episode.Duration.String()
+		}
+		for _, message := range episode.WebSocketMessages {
+			var data interface{} = string(message.Data)
+			if message.Binary {
+				data = message.Data
+			}
+			writeable.WebSocketMessages = append(writeable.WebSocketMessages, WriteableWebSocketMessage{
+				From:    message.From,
+				Binary:  message.Binary,
+				Data:    data,
+				Elapsed: message.Elapsed.String(),
+			})
+		}
 
 		writeables[i] = writeable
 	}
@@ -101,49 +401,279 @@ func episodes(writeableEpisodes []WriteableEpisode) []Episode {
 	episodes := make([]Episode, len(writeableEpisodes))
 	for i, writeableEpisode := range writeableEpisodes {
 		request := RecordedRequest{
-			Method: writeableEpisode.Request.Method,
-			URL:    writeableEpisode.Request.URL,
-			Header: writeableEpisode.Request.Header,
-			Body:   bodyForContentType(writeableEpisode.Request.Body, writeableEpisode.Request.Header),
-			Form:   writeableEpisode.Request.Form,
+			Target:   writeableEpisode.Request.Target,
+			Method:   writeableEpisode.Request.Method,
+			Host:     writeableEpisode.Request.Host,
+			URL:      writeableEpisode.Request.URL,
+			Header:   writeableEpisode.Request.Header,
+			Body:     bodyForContentType(writeableEpisode.Request.Body, writeableEpisode.Request.Header),
+			Form:     writeableEpisode.Request.Form,
+			BodyBlob: writeableEpisode.Request.BodyBlob,
 		}
 
 		response := RecordedResponse{
-			StatusCode: writeableEpisode.Response.StatusCode,
-			Header:     writeableEpisode.Response.Header,
-			Body:       bodyForContentType(writeableEpisode.Response.Body, writeableEpisode.Response.Header),
+			StatusCode:      writeableEpisode.Response.StatusCode,
+			Header:          writeableEpisode.Response.Header,
+			Body:            bodyForContentType(writeableEpisode.Response.Body, writeableEpisode.Response.Header),
+			ContentEncoding: writeableEpisode.Response.ContentEncoding,
+			BodyBlob:        writeableEpisode.Response.BodyBlob,
+		}
+		for _, chunk := range writeableEpisode.Response.Chunks {
+			elapsed, _ := time.ParseDuration(chunk.Elapsed)
+			response.Chunks = append(response.Chunks, Chunk{Size: chunk.Size, Elapsed: elapsed})
 		}
 
 		episode := Episode{
 			Request:  request,
 			Response: response,
 		}
+		if writeableEpisode.RecordedAt != nil {
+			episode.RecordedAt = *writeableEpisode.RecordedAt
+		}
+		episode.Duration, _ = time.ParseDuration(writeableEpisode.Duration)
+		for _, message := range writeableEpisode.WebSocketMessages {
+			encoded, _ := message.Data.(string)
+			data := []byte(encoded)
+			if message.Binary {
+				data, _ = base64.StdEncoding.DecodeString(encoded)
+			}
+			elapsed, _ := time.ParseDuration(message.Elapsed)
+			episode.WebSocketMessages = append(episode.WebSocketMessages, WebSocketMessage{
+				From:    message.From,
+				Binary:  message.Binary,
+				Data:    data,
+				Elapsed: elapsed,
+			})
+		}
 
 		episodes[i] = episode
 	}
 	return episodes
 }
 
+// whether unrecorded requests should be proxied and recorded
+// under the current record mode
+func (c *Config) recordsNewEpisodes() bool {
+	switch c.RecordMode {
+	case "", RecordNewEpisodes, RecordAll:
+		return true
+	case RecordOnce:
+		return !c.cassetteExisted
+	}
+	return false
+}
+
+// whether recorded episodes should be served under the current record mode
+func (c *Config) replaysEpisodes() bool {
+	return c.RecordMode != RecordAll
+}
+
+// whether an episode is older than the re-record interval. episodes that
+// do not know when they were recorded count as expired.
+func (c *Config) expired(episode *Episode) bool {
+	if c.ReRecordInterval <= 0 || c.RecordMode == RecordNone {
+		return false
+	}
+	return time.Since(episode.RecordedAt) > time.Duration(c.ReRecordInterval)*time.Second
+}
+
+// the format the current cassette is read and written in
+func (c *Config) cassetteFormat() (CassetteFormat, error) {
+	if c.foundFormat != "" {
+		return lookupCassetteFormat(c.foundFormat)
+	}
+	return lookupCassetteFormat(c.CassetteFormat)
+}
+
+func (c *Config) cassettePath() string {
+	format, err := c.cassetteFormat()
+	if err != nil {
+		format = jsonFormat{}
+	}
+	filename, _ := c.cassettePathFor(format)
+	return filename
+}
+
+// Save writes all episodes to the cassette file. The file is replaced
+// atomically, and the cassette directory is locked while writing so other
+// betamax processes never read or write a half-written cassette.
 func (c *Config) Save() error {
-	episodes := writeableEpisodes(c.Episodes)
+	os.MkdirAll(c.CassetteDir, 0700)
+	unlock, err := lockDir(c.CassetteDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return c.writeCassette()
+}
+
+// Load reads the episodes of the current cassette from disk, in whichever
+// format the cassette file's extension says it was written. A missing
+// cassette loads as empty and returns an error satisfying os.IsNotExist.
+func (c *Config) Load() error {
+	c.Episodes = []Episode{}
+	c.cassetteExisted = false
+
+	unlock, err := lockDir(c.CassetteDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	jsonData, err := json.MarshalIndent(&episodes, "", "  ")
+	c.detectCassetteFormat()
+	episodes, err := c.readCassette()
 	if err != nil {
 		return err
 	}
+	c.Episodes = episodes
+	c.cassetteExisted = true
+	return nil
+}
+
+// saveRecorded writes newly recorded episodes into the cassette on top of
+// whatever is on disk right now, so episodes recorded by another betamax
+// process sharing the cassette directory are kept rather than overwritten.
+// The merged episodes become the config's episodes.
+func (c *Config) saveRecorded(recorded []recordedEpisode) error {
 	os.MkdirAll(c.CassetteDir, 0700)
-	return ioutil.WriteFile(path.Join(c.CassetteDir, c.Cassette+".json"), jsonData, 0700)
+	unlock, err := lockDir(c.CassetteDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c.detectCassetteFormat()
+	onDisk, err := c.readCassette()
+	if err != nil && !os.IsNotExist(err) {
+		// never overwrite a cassette we cannot make sense of
+		return err
+	}
+
+	c.Episodes = onDisk
+	for _, r := range recorded {
+		c.addEpisode(r.episode, r.replace)
+	}
+	return c.writeCassette()
 }
 
-func (c *Config) Load() error {
+// returns a copy of the config that shares no slices with it, so decoding
+// an update into the copy can't write into the original. episodes are
+// never modified in place, so they are shared.
+func (c *Config) clone() *Config {
+	clone := *c
+	clone.MatchHeaders = copyStrings(c.MatchHeaders)
+	clone.MatchOn = copyStrings(c.MatchOn)
+	clone.IgnoreQueryParams = copyStrings(c.IgnoreQueryParams)
+	clone.MatchQueryParams = copyStrings(c.MatchQueryParams)
+	clone.IgnoreJSONPaths = copyStrings(c.IgnoreJSONPaths)
+	clone.Redact.Headers = copyStrings(c.Redact.Headers)
+	clone.Redact.QueryParams = copyStrings(c.Redact.QueryParams)
+	clone.Redact.FormFields = copyStrings(c.Redact.FormFields)
+	clone.Redact.JSONPaths = copyStrings(c.Redact.JSONPaths)
+	clone.Redact.BodyPatterns = copyStrings(c.Redact.BodyPatterns)
+	if c.Routes != nil {
+		clone.Routes = append([]Route{}, c.Routes...)
+	}
+	if c.LatencyRules != nil {
+		clone.LatencyRules = append([]LatencyRule{}, c.LatencyRules...)
+	}
+	if c.Faults != nil {
+		clone.Faults = append([]FaultRule{}, c.Faults...)
+	}
+	return &clone
+}
+
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string{}, values...)
+}
+
+// adds an episode and returns its index. it replaces the episode at index
+// replace instead, if that is an episode for the same request; the
+// cassette may have changed on disk since replace was picked. a new slice
+// is always allocated, since other snapshots of the config may still be
+// reading the old one.
+func (c *Config) addEpisode(episode Episode, replace int) int {
+	index := -1
+	if replace >= 0 && replace < len(c.Episodes) &&
+		sameRequest(&c.Episodes[replace].Request, matchableRequest(episode.Request.httpRequest(), c), *c) {
+		index = replace
+	}
 
-	cassetteData, err := ioutil.ReadFile(path.Join(c.CassetteDir, c.Cassette+".json"))
+	episodes := make([]Episode, len(c.Episodes), len(c.Episodes)+1)
+	copy(episodes, c.Episodes)
+	if index >= 0 {
+		episodes[index] = episode
+	} else {
+		index = len(episodes)
+		episodes = append(episodes, episode)
+	}
+	c.Episodes = episodes
+	return index
+}
+
+// reads the cassette file; the caller must hold the cassette directory lock
+func (c *Config) readCassette() ([]Episode, error) {
+	format, err := c.cassetteFormat()
+	if err != nil {
+		return nil, err
+	}
+	cassetteData, err := ioutil.ReadFile(c.cassettePath())
+	if err != nil {
+		return nil, err
+	}
+	cassette, err := format.Unmarshal(cassetteData)
+	if err != nil {
+		return nil, fmt.Errorf("cassette %s is corrupt: %s", c.cassettePath(), err)
+	}
+	return cassette.Episodes, nil
+}
+
+// writes the cassette file; the caller must hold the cassette directory lock
+func (c *Config) writeCassette() error {
+	format, err := c.cassetteFormat()
+	if err != nil {
+		return err
+	}
+	data, err := format.Marshal(Cassette{Name: c.Cassette, TargetURL: c.TargetURL, Episodes: c.Episodes})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.cassettePath(), data, 0700)
+}
+
+// writes data to a temporary file next to filename and renames it into
+// place, so readers see either the old or the new contents, never a
+// truncated file.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir, base := path.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
 	if err != nil {
-		c.Episodes = []Episode{}
 		return err
 	}
-	writableEpisodes := []WriteableEpisode{}
-	err = json.Unmarshal(cassetteData, &writableEpisodes)
-	c.Episodes = episodes(writableEpisodes)
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
 	return err
 }
@@ -6,9 +6,10 @@ import (
 	. "github.com/thegreatape/betamax/proxy"
 	"io/ioutil"
 	"net/http"
-
+	"net/url"
 	"os"
 	"path"
+	"time"
 )
 
 var _ = Describe("Config", func() {
@@ -73,10 +74,207 @@ var _ = Describe("Config", func() {
 		Expect(cassetteJSON).To(MatchRegexp(`"Body": "Z29vZGJ5ZSE="`))
 	})
 
+	It("replaces the cassette file without leaving temporary files behind", func() {
+		config := Config{Cassette: "test", CassetteDir: cassetteDir}
+		Expect(config.Save()).To(Succeed())
+
+		config.Episodes = []Episode{{Request: RecordedRequest{Method: "GET"}}}
+		Expect(config.Save()).To(Succeed())
+
+		files, err := ioutil.ReadDir(cassetteDir)
+		Expect(err).To(BeNil())
+		Expect(files).To(HaveLen(1))
+		Expect(files[0].Name()).To(Equal("test.json"))
+
+		loaded := Config{Cassette: "test", CassetteDir: cassetteDir}
+		Expect(loaded.Load()).To(Succeed())
+		Expect(loaded.Episodes).To(HaveLen(1))
+	})
+
+	It("reports corrupt cassettes instead of loading them as empty", func() {
+		os.MkdirAll(cassetteDir, 0700)
+		ioutil.WriteFile(path.Join(cassetteDir, "test.json"), []byte(`[{"Req`), 0700)
+
+		config := Config{Cassette: "test", CassetteDir: cassetteDir}
+		err := config.Load()
+		Expect(err).ToNot(BeNil())
+		Expect(os.IsNotExist(err)).To(BeFalse())
+	})
+
+	It("upgrades cassettes written as a bare array of episodes", func() {
+		os.MkdirAll(cassetteDir, 0700)
+		ioutil.WriteFile(path.Join(cassetteDir, "test.json"), []byte(`[
+  {
+    "Request": {"Method": "GET", "Host": "localhost", "URL": {"Path": "/old"}, "Header": {}, "Body": null, "Form": {}},
+    "Response": {"StatusCode": 200, "Body": "b2xk", "Header": {}}
+  }
+]`), 0700)
+
+		config := Config{Cassette: "test", CassetteDir: cassetteDir, TargetURL: "http://example.com"}
+		Expect(config.Load()).To(Succeed())
+		Expect(config.Episodes).To(HaveLen(1))
+		Expect(config.Episodes[0].Request.URL.Path).To(Equal("/old"))
+		Expect(string(config.Episodes[0].Response.Body)).To(Equal("old"))
+		Expect(config.Episodes[0].RecordedAt.IsZero()).To(BeTrue())
+
+		config.Episodes[0].RecordedAt = time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+		config.Episodes[0].Duration = 1500 * time.Millisecond
+		Expect(config.Save()).To(Succeed())
+
+		cassetteJSON, _ := readCassette("test")
+		Expect(cassetteJSON).To(ContainSubstring(`"format_version": 2`))
+		Expect(cassetteJSON).To(ContainSubstring(`"target_url": "http://example.com"`))
+		Expect(cassetteJSON).To(ContainSubstring(`"RecordedAt": "2020-05-04T10:00:00Z"`))
+		Expect(cassetteJSON).To(ContainSubstring(`"Duration": "1.5s"`))
+
+		loaded := Config{Cassette: "test", CassetteDir: cassetteDir}
+		Expect(loaded.Load()).To(Succeed())
+		Expect(loaded.Episodes[0].RecordedAt).To(Equal(config.Episodes[0].RecordedAt))
+		Expect(loaded.Episodes[0].Duration).To(Equal(1500 * time.Millisecond))
+	})
+
+	It("refuses cassettes written in a newer format version", func() {
+		os.MkdirAll(cassetteDir, 0700)
+		ioutil.WriteFile(path.Join(cassetteDir, "test.json"), []byte(`{"format_version": 99, "episodes": []}`), 0700)
+
+		config := Config{Cassette: "test", CassetteDir: cassetteDir}
+		err := config.Load()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("format version 99"))
+	})
+
+	It("writes VCR compatible YAML cassettes", func() {
+		request := RecordedRequest{
+			Method: "POST",
+			Host:   "example.com",
+			URL:    &url.URL{Path: "/things", RawQuery: "a=1"},
+			Header: http.Header{"Content-Type": []string{"text/plain"}},
+			Body:   []byte("hello!"),
+		}
+		response := RecordedResponse{
+			StatusCode: 201,
+			Header:     http.Header{"Content-Type": []string{"image/png"}},
+			Body:       []byte{0x89, 0x50, 0x4e, 0x47, 0xff},
+		}
+		config := Config{
+			Cassette:       "test",
+			CassetteDir:    cassetteDir,
+			CassetteFormat: FormatVCRYAML,
+			Episodes:       []Episode{{Request: request, Response: response}},
+		}
+		Expect(config.Save()).To(Succeed())
+
+		data, err := ioutil.ReadFile(path.Join(cassetteDir, "test.yml"))
+		Expect(err).To(BeNil())
+		cassette := string(data)
+		Expect(cassette).To(ContainSubstring("http_interactions:"))
+		Expect(cassette).To(ContainSubstring("method: post"))
+		Expect(cassette).To(ContainSubstring("uri: http://example.com/things?a=1"))
+		Expect(cassette).To(ContainSubstring("string: hello!"))
+		Expect(cassette).To(ContainSubstring("code: 201"))
+		Expect(cassette).To(ContainSubstring("encoding: ASCII-8BIT"))
+		Expect(cassette).To(ContainSubstring("base64_string: iVBOR/8="))
+
+		loaded := Config{Cassette: "test", CassetteDir: cassetteDir}
+		Expect(loaded.Load()).To(Succeed())
+		// the cassette keeps its format, the configured one stays as it is
+		Expect(loaded.CassetteFormat).To(BeEmpty())
+		Expect(loaded.Save()).To(Succeed())
+		_, err = os.Stat(path.Join(cassetteDir, "test.json"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		Expect(loaded.Episodes).To(HaveLen(1))
+		Expect(loaded.Episodes[0].Request.Method).To(Equal("POST"))
+		Expect(loaded.Episodes[0].Request.URL.Path).To(Equal("/things"))
+		Expect(loaded.Episodes[0].Response.Body).To(Equal(response.Body))
+	})
+
+	It("keeps timings and WebSocket messages in YAML cassettes", func() {
+		episode := Episode{
+			Request: RecordedRequest{Method: "GET", Host: "example.com", URL: &url.URL{Path: "/events"}, Header: http.Header{}},
+			Response: RecordedResponse{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+				Body:       []byte("data: 1\n\ndata: 2\n\n"),
+				Chunks:     []Chunk{{Size: 9, Elapsed: 10 * time.Millisecond}, {Size: 9, Elapsed: 250 * time.Millisecond}},
+			},
+			Duration: 300 * time.Millisecond,
+			WebSocketMessages: []WebSocketMessage{
+				{From: FromClient, Data: []byte("hello"), Elapsed: time.Millisecond},
+				{From: FromServer, Binary: true, Data: []byte{0xff, 0x00}, Elapsed: 2 * time.Millisecond},
+			},
+		}
+		config := Config{Cassette: "test", CassetteDir: cassetteDir, CassetteFormat: FormatVCRYAML, Episodes: []Episode{episode}}
+		Expect(config.Save()).To(Succeed())
+
+		loaded := Config{Cassette: "test", CassetteDir: cassetteDir}
+		Expect(loaded.Load()).To(Succeed())
+		Expect(loaded.Episodes).To(HaveLen(1))
+		Expect(loaded.Episodes[0].Duration).To(Equal(episode.Duration))
+		Expect(loaded.Episodes[0].Response.Chunks).To(Equal(episode.Response.Chunks))
+		Expect(loaded.Episodes[0].WebSocketMessages).To(Equal(episode.WebSocketMessages))
+	})
+
+	It("loads cassettes recorded by Ruby's VCR", func() {
+		os.MkdirAll(cassetteDir, 0700)
+		ioutil.WriteFile(path.Join(cassetteDir, "test.yaml"), []byte(`---
+http_interactions:
+- request:
+    method: get
+    uri: http://api.example.com/users?page=2
+    body:
+      encoding: US-ASCII
+      string: ''
+    headers:
+      accept:
+      - "*/*"
+  response:
+    status:
+      code: 200
+      message: OK
+    headers:
+      content-type:
+      - application/json
+    body:
+      encoding: UTF-8
+      base64_string: |
+        eyJ1c2VycyI6IFtdfQ==
+    http_version:
+  recorded_at: Tue, 01 Nov 2011 04:58:44 GMT
+recorded_with: VCR 6.0.0
+`), 0700)
+
+		config := Config{Cassette: "test", CassetteDir: cassetteDir}
+		Expect(config.Load()).To(Succeed())
+		Expect(config.CassetteFormat).To(BeEmpty())
+		Expect(config.Episodes).To(HaveLen(1))
+
+		episode := config.Episodes[0]
+		Expect(episode.Request.Method).To(Equal("GET"))
+		Expect(episode.Request.Host).To(Equal("api.example.com"))
+		Expect(episode.Request.URL.RawQuery).To(Equal("page=2"))
+		Expect(episode.Request.Header.Get("Accept")).To(Equal("*/*"))
+		Expect(episode.Response.StatusCode).To(Equal(200))
+		Expect(episode.Response.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(string(episode.Response.Body)).To(Equal(`{"users": []}`))
+
+		config.Episodes = append(config.Episodes, Episode{Request: RecordedRequest{Method: "GET", URL: &url.URL{Path: "/"}}})
+		Expect(config.Save()).To(Succeed())
+		files, _ := ioutil.ReadDir(cassetteDir)
+		Expect(files).To(HaveLen(1))
+		Expect(files[0].Name()).To(Equal("test.yaml"))
+	})
+
 	It("knows which content types are plain text", func() {
 		Expect(IsText(map[string][]string{"Content-Type": []string{"text/json"}})).To(BeTrue())
 		Expect(IsText(map[string][]string{"Content-Type": []string{"image/jpg"}})).To(BeFalse())
 		Expect(IsText(map[string][]string{"Content-Type": []string{"application/json"}})).To(BeTrue())
 	})
 
+	It("knows which content types are JSON", func() {
+		Expect(IsJSON(map[string][]string{"Content-Type": []string{"application/json; charset=utf-8"}})).To(BeTrue())
+		Expect(IsJSON(map[string][]string{"Content-Type": []string{"application/vnd.api+json"}})).To(BeTrue())
+		Expect(IsJSON(map[string][]string{"Content-Type": []string{"text/plain"}})).To(BeFalse())
+		Expect(IsJSON(map[string][]string{})).To(BeFalse())
+	})
+
 })
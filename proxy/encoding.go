@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decodes a response body compressed with gzip, deflate or br, so that it
+// is stored readably. the encoding is remembered in ContentEncoding so the
+// body can be compressed again on replay. responses that can't be decoded
+// are returned unchanged.
+func decodeResponse(resp RecordedResponse) RecordedResponse {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	// blobs are stored as they were sent
+	if encoding == "" || encoding == "identity" || resp.BodyBlob != "" {
+		return resp
+	}
+
+	body, err := decodeBody(resp.Body, encoding)
+	if err != nil {
+		return resp
+	}
+
+	decoded := resp
+	decoded.Body = body
+	decoded.ContentEncoding = encoding
+	// chunk sizes refer to the compressed stream
+	decoded.Chunks = nil
+	decoded.Header = http.Header{}
+	for key, values := range resp.Header {
+		decoded.Header[key] = values
+	}
+	decoded.Header.Del("Content-Encoding")
+	decoded.Header.Del("Content-Length")
+	return decoded
+}
+
+func decodeBody(body []byte, encoding string) ([]byte, error) {
+	var reader io.Reader
+	var err error
+
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate is supposed to be zlib wrapped, but plenty of servers
+		// send raw deflate streams
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func encodeBody(body []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+
+	switch encoding {
+	case "gzip", "x-gzip":
+		writer = gzip.NewWriter(&buf)
+	case "deflate":
+		writer = zlib.NewWriter(&buf)
+	case "br":
+		writer = brotli.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// whether a request's Accept-Encoding allows the given encoding
+func acceptsEncoding(header http.Header, encoding string) bool {
+	for _, accept := range strings.Split(header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(accept, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
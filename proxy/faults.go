@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// FaultKind is the failure a fault rule injects.
+type FaultKind string
+
+const (
+	// answer with StatusCode and Body instead of the real response
+	FaultStatus FaultKind = "status"
+	// send the headers and part of the body, then close the connection
+	FaultDropBody FaultKind = "drop_body"
+	// reset the TCP connection without answering
+	FaultReset FaultKind = "reset"
+	// never answer, until the client gives up
+	FaultHang FaultKind = "hang"
+	// answer with a body that cannot be parsed
+	FaultMalformedBody FaultKind = "malformed_body"
+)
+
+func (k FaultKind) Valid() bool {
+	switch k {
+	case FaultStatus, FaultDropBody, FaultReset, FaultHang, FaultMalformedBody:
+		return true
+	}
+	return false
+}
+
+// FaultRule makes the proxy fail requests matching Method and Path instead
+// of proxying or replaying them, to test how clients cope with failures.
+type FaultRule struct {
+	// HTTP method the rule applies to; any if empty
+	Method string `json:"method"`
+	// regular expression matched against the request path; any if empty
+	Path  string    `json:"path"`
+	Fault FaultKind `json:"fault"`
+	// status code for status and malformed_body faults; 500 and 200 if unset
+	StatusCode int `json:"status_code"`
+	// body for status and malformed_body faults
+	Body string `json:"body"`
+	// chance between 0 and 1 that a matching request fails; 1 if unset
+	Probability *float64 `json:"probability"`
+	// how many requests the rule fails at most; unlimited if zero
+	Count int `json:"count"`
+
+	// Path, compiled by normalize
+	path *regexp.Regexp
+}
+
+// checks the rule and fills in defaults
+func (r *FaultRule) normalize() error {
+	if !r.Fault.Valid() {
+		return fmt.Errorf("unknown fault %q", r.Fault)
+	}
+	path, err := regexp.Compile(r.Path)
+	if err != nil {
+		return err
+	}
+	r.path = path
+	if probability := r.probability(); probability < 0 || probability > 1 {
+		return fmt.Errorf("fault probability must be between 0 and 1")
+	}
+	if r.Count < 0 {
+		return fmt.Errorf("fault count must not be negative")
+	}
+	return nil
+}
+
+func (r *FaultRule) matches(req *http.Request) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+	if r.path == nil {
+		// a rule set up in Go rather than through JSON was never normalized
+		matched, err := regexp.MatchString(r.Path, req.URL.Path)
+		return err == nil && matched
+	}
+	return r.path.MatchString(req.URL.Path)
+}
+
+func (r *FaultRule) probability() float64 {
+	if r.Probability == nil {
+		return 1
+	}
+	return *r.Probability
+}
+
+// picks the fault to inject into req, if any. each matching rule gets its
+// chance in turn, until one fires or has failed Count requests already.
+func (s *store) injectFault(req *http.Request, config *Config) *FaultRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range config.Faults {
+		rule := &config.Faults[i]
+		if !rule.matches(req) {
+			continue
+		}
+		if rule.Count > 0 && s.injected[i] >= rule.Count {
+			continue
+		}
+		if rand.Float64() >= rule.probability() {
+			continue
+		}
+		if s.injected == nil {
+			s.injected = map[int]int{}
+		}
+		s.injected[i]++
+		return rule
+	}
+	return nil
+}
+
+// fails requests according to the config's fault rules, before they
+// reach the cassette
+func faultHandler(handler http.Handler, store *store) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		config := store.Config()
+		if len(config.Faults) == 0 {
+			handler.ServeHTTP(resp, req)
+			return
+		}
+
+		rule := store.injectFault(req, config)
+		if rule == nil {
+			handler.ServeHTTP(resp, req)
+			return
+		}
+		serveFault(rule, resp, req)
+	})
+}
+
+func serveFault(rule *FaultRule, resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("X-Betamax-Fault", string(rule.Fault))
+
+	switch rule.Fault {
+	case FaultStatus:
+		statusCode := rule.StatusCode
+		if statusCode == 0 {
+			statusCode = 500
+		}
+		body := rule.Body
+		if body == "" {
+			body = "betamax: injected fault"
+		}
+		http.Error(resp, body, statusCode)
+
+	case FaultMalformedBody:
+		statusCode := rule.StatusCode
+		if statusCode == 0 {
+			statusCode = 200
+		}
+		body := rule.Body
+		if body == "" {
+			body = `{"betamax": "injected fault", "truncated`
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(statusCode)
+		resp.Write([]byte(body))
+
+	case FaultDropBody:
+		// promise more than is sent, so the client notices the body is cut off
+		body := []byte(`{"betamax": "injected fault", "truncated": "`)
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("Content-Length", fmt.Sprint(len(body)*4))
+		resp.WriteHeader(200)
+		resp.Write(body)
+		if flusher, ok := resp.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		// makes net/http close the connection without logging a panic
+		panic(http.ErrAbortHandler)
+
+	case FaultReset:
+		hijacker, ok := resp.(http.Hijacker)
+		if !ok {
+			panic(http.ErrAbortHandler)
+		}
+		conn, _, err := hijacker.Hijack()
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		// closing with a zero linger time sends a RST instead of a FIN
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+		conn.Close()
+
+	case FaultHang:
+		<-req.Context().Done()
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// CassetteFormat turns the episodes of a cassette into the contents of a
+// cassette file and back.
+type CassetteFormat interface {
+	// file extensions used by the format, including the dot; new cassettes
+	// get the first one
+	Extensions() []string
+	Marshal(cassette Cassette) ([]byte, error)
+	Unmarshal(data []byte) (Cassette, error)
+}
+
+const (
+	// betamax's own JSON cassettes
+	FormatJSON = "json"
+	// YAML cassettes compatible with Ruby's VCR
+	FormatVCRYAML = "vcr_yaml"
+	// HTTP Archive files, as saved by browser devtools
+	FormatHAR = "har"
+)
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[string]CassetteFormat{
+		FormatJSON:    jsonFormat{},
+		FormatVCRYAML: vcrYAMLFormat{},
+		FormatHAR:     harFormat{},
+	}
+)
+
+// RegisterCassetteFormat makes a cassette format available under name for
+// use in cassette_format, replacing any format already registered under
+// that name.
+func RegisterCassetteFormat(name string, format CassetteFormat) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats[name] = format
+}
+
+func lookupCassetteFormat(name string) (CassetteFormat, error) {
+	if name == "" {
+		name = FormatJSON
+	}
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	format, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cassette format %q", name)
+	}
+	return format, nil
+}
+
+// names of the registered formats, the given one first and the rest in a
+// stable order
+func formatNames(first string) []string {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	names := []string{}
+	for name := range formats {
+		if name != first {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := formats[first]; ok {
+		names = append([]string{first}, names...)
+	}
+	return names
+}
+
+// the file of the cassette in the given format: an existing file with one
+// of the format's extensions, or the file a new cassette would be written to
+func (c *Config) cassettePathFor(format CassetteFormat) (string, bool) {
+	extensions := format.Extensions()
+	for _, ext := range extensions {
+		filename := path.Join(c.CassetteDir, c.Cassette+ext)
+		if _, err := os.Stat(filename); err == nil {
+			return filename, true
+		}
+	}
+	return path.Join(c.CassetteDir, c.Cassette+extensions[0]), false
+}
+
+// looks for the cassette file on disk, so that a cassette written in a
+// format other than the configured one keeps its format. the configured
+// format is left alone for other cassettes. the caller must hold the
+// cassette directory lock.
+func (c *Config) detectCassetteFormat() {
+	c.foundFormat = ""
+	configured := c.CassetteFormat
+	if configured == "" {
+		configured = FormatJSON
+	}
+	for _, name := range formatNames(configured) {
+		format, err := lookupCassetteFormat(name)
+		if err != nil {
+			continue
+		}
+		if _, exists := c.cassettePathFor(format); exists {
+			c.foundFormat = name
+			return
+		}
+	}
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) Extensions() []string {
+	return []string{".json"}
+}
+
+func (jsonFormat) Marshal(cassette Cassette) ([]byte, error) {
+	writeable := WriteableCassette{
+		FormatVersion:  CassetteFormatVersion,
+		BetamaxVersion: Version,
+		TargetURL:      cassette.TargetURL,
+		Episodes:       writeableEpisodes(cassette.Episodes),
+	}
+	return json.MarshalIndent(&writeable, "", "  ")
+}
+
+// cassettes written in older format versions are migrated when they are
+// read, and written in the current version the next time they are saved
+func (jsonFormat) Unmarshal(data []byte) (Cassette, error) {
+	version, err := jsonCassetteVersion(data)
+	if err != nil {
+		return Cassette{}, err
+	}
+	if version > CassetteFormatVersion {
+		return Cassette{}, fmt.Errorf("format version %d is newer than the supported version %d", version, CassetteFormatVersion)
+	}
+	for ; version < CassetteFormatVersion; version++ {
+		if data, err = jsonCassetteMigrations[version-1](data); err != nil {
+			return Cassette{}, err
+		}
+	}
+
+	writeable := WriteableCassette{}
+	if err := json.Unmarshal(data, &writeable); err != nil {
+		return Cassette{}, err
+	}
+	return Cassette{TargetURL: writeable.TargetURL, Episodes: episodes(writeable.Episodes)}, nil
+}
+
+// the current version of the JSON cassette format
+const CassetteFormatVersion = 2
+
+// upgrade JSON cassettes from older format versions; the migration at
+// index i turns version i+1 into version i+2
+var jsonCassetteMigrations = []func(data []byte) ([]byte, error){
+	// version 1 was a bare array of episodes
+	func(data []byte) ([]byte, error) {
+		return json.Marshal(map[string]interface{}{
+			"format_version": 2,
+			"episodes":       json.RawMessage(data),
+		})
+	},
+}
+
+func jsonCassetteVersion(data []byte) (int, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return 1, nil
+	}
+	header := struct {
+		FormatVersion int `json:"format_version"`
+	}{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, err
+	}
+	if header.FormatVersion < 1 {
+		return 0, fmt.Errorf("missing format_version")
+	}
+	return header.FormatVersion, nil
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+)
+
+// ForwardProxy returns a proxy for clients that send their traffic through
+// it via HTTP_PROXY and HTTPS_PROXY, instead of one fixed target. HTTPS
+// requests tunneled with CONNECT are decrypted using certificates signed by
+// ca, so they can be recorded and replayed like plain HTTP. Episodes record
+// the host they were sent to, and the host is matched on by default.
+//
+// Upstream requests are sent with upstream, or a transport ignoring the
+// proxy environment variables if it is nil.
+func ForwardProxy(cassetteDir string, ca *CertificateAuthority, upstream http.RoundTripper) http.Handler {
+	if upstream == nil {
+		upstream = &http.Transport{}
+	}
+
+	forward := &httputil.ReverseProxy{
+		// requests to a forward proxy already carry the absolute target url
+		Director: func(req *http.Request) {
+			if req.URL.Scheme == "" {
+				req.URL.Scheme = "http"
+			}
+			if req.URL.Host == "" {
+				req.URL.Host = req.Host
+			}
+		},
+		Transport:    upstream,
+		ErrorHandler: upstreamErrorHandler,
+	}
+
+	config := defaultConfig(cassetteDir)
+	config.MatchOn = []string{"target", "method", "host", "path", "query", "headers", "body"}
+	sessions := newSessions(forward, newStore(config))
+	sessions.root = connectHandler(sessions, ca)
+	return &forwardProxy{handler: sessions.root, sessions: sessions}
+}
+
+// the forward proxy's handler, which keeps hold of its sessions for Flush
+type forwardProxy struct {
+	handler  http.Handler
+	sessions *sessions
+}
+
+func (f *forwardProxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	f.handler.ServeHTTP(resp, req)
+}
+
+func (f *forwardProxy) flush() error {
+	return f.sessions.flush()
+}
+
+// intercepts CONNECT tunnels: the client is answered as if the tunnel had
+// been opened, then its TLS connection is terminated with a certificate for
+// the requested host, and the decrypted requests are passed to handler.
+func connectHandler(handler http.Handler, ca *CertificateAuthority) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" {
+			handler.ServeHTTP(resp, req)
+			return
+		}
+
+		hijacker, ok := resp.(http.Hijacker)
+		if !ok {
+			http.Error(resp, "betamax: connection cannot be hijacked", 500)
+			return
+		}
+		conn, _, err := hijacker.Hijack()
+		if err != nil {
+			http.Error(resp, err.Error(), 500)
+			return
+		}
+
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			conn.Close()
+			return
+		}
+
+		target := req.Host
+		hostname, _, err := net.SplitHostPort(target)
+		if err != nil {
+			hostname = target
+		}
+
+		tlsConn := tls.Server(conn, &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if hello.ServerName != "" {
+					return ca.certificate(hello.ServerName)
+				}
+				return ca.certificate(hostname)
+			},
+		})
+
+		tunnel := &http.Server{
+			// requests in the tunnel belong to the session of the CONNECT
+			BaseContext: func(net.Listener) context.Context {
+				return req.Context()
+			},
+			Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				req.URL.Scheme = "https"
+				req.URL.Host = target
+				handler.ServeHTTP(resp, req)
+			}),
+		}
+		tunnel.Serve(newSingleConnListener(tlsConn))
+	})
+}
+
+// a listener handing out one connection, whose Accept fails once that
+// connection is closed, so an http.Server serving it returns
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = &notifyingConn{Conn: l.conn, closed: l.closed}
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, io.EOF
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type notifyingConn struct {
+	net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *notifyingConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.closed) })
+	return err
+}
@@ -0,0 +1,155 @@
+package proxy_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/thegreatape/betamax/proxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sync/atomic"
+)
+
+var _ = Describe("ForwardProxy", func() {
+	var proxyListener net.Listener
+	var proxyAddress string
+	var httpsTarget *httptest.Server
+	var httpTarget *httptest.Server
+	var client *http.Client
+	var cassetteDir string
+	var caDir string
+	var requestCount int64
+
+	configureProxy := func(options map[string]interface{}) {
+		jsonBytes, err := json.Marshal(options)
+		Expect(err).To(BeNil())
+
+		_, err = http.Post(fmt.Sprintf("http://%s/__betamax__/config", proxyAddress), "text/json", bytes.NewBuffer(jsonBytes))
+		Expect(err).To(BeNil())
+	}
+
+	get := func(target string) (string, error) {
+		resp, err := client.Get(target)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	BeforeEach(func() {
+		requestCount = 0
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			count := atomic.AddInt64(&requestCount, 1)
+			io.WriteString(writer, fmt.Sprintf("%s %d", request.URL.Path, count))
+		})
+		httpsTarget = httptest.NewTLSServer(handler)
+		httpTarget = httptest.NewServer(handler)
+
+		cassetteDir, _ = ioutil.TempDir("", "cassettes")
+		caDir, _ = ioutil.TempDir("", "ca")
+		ca, err := LoadOrCreateCA(caDir)
+		Expect(err).To(BeNil())
+
+		proxyListener, _ = net.Listen("tcp", "127.0.0.1:0")
+		proxyAddress = proxyListener.Addr().String()
+		go http.Serve(proxyListener, ForwardProxy(cassetteDir, ca, httpsTarget.Client().Transport))
+
+		// the client only trusts the CA the proxy wrote to disk
+		caPEM, err := ioutil.ReadFile(path.Join(caDir, CACertificateFile))
+		Expect(err).To(BeNil())
+		roots := x509.NewCertPool()
+		Expect(roots.AppendCertsFromPEM(caPEM)).To(BeTrue())
+
+		proxyURL, _ := url.Parse("http://" + proxyAddress)
+		client = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	})
+
+	AfterEach(func() {
+		httpsTarget.Close()
+		httpTarget.Close()
+		proxyListener.Close()
+		os.RemoveAll(cassetteDir)
+		os.RemoveAll(caDir)
+	})
+
+	It("proxies HTTPS requests through CONNECT tunnels", func() {
+		body, err := get(httpsTarget.URL + "/hello")
+		Expect(err).To(BeNil())
+		Expect(body).To(Equal("/hello 1"))
+	})
+
+	It("records and replays decrypted HTTPS traffic", func() {
+		configureProxy(map[string]interface{}{"cassette": "forward"})
+
+		body, err := get(httpsTarget.URL + "/hello")
+		Expect(err).To(BeNil())
+		Expect(body).To(Equal("/hello 1"))
+
+		httpsTarget.Close()
+
+		body, err = get(httpsTarget.URL + "/hello")
+		Expect(err).To(BeNil())
+		Expect(body).To(Equal("/hello 1"))
+	})
+
+	It("keys episodes by host", func() {
+		configureProxy(map[string]interface{}{"cassette": "forward", "flush_interval_ms": 0})
+
+		body, _ := get(httpsTarget.URL + "/same-path")
+		Expect(body).To(Equal("/same-path 1"))
+
+		body, _ = get(httpTarget.URL + "/same-path")
+		Expect(body).To(Equal("/same-path 2"))
+
+		body, _ = get(httpsTarget.URL + "/same-path")
+		Expect(body).To(Equal("/same-path 1"))
+
+		cassetteData, err := ioutil.ReadFile(path.Join(cassetteDir, "forward.json"))
+		Expect(err).To(BeNil())
+		var cassette WriteableCassette
+		Expect(json.Unmarshal(cassetteData, &cassette)).To(Succeed())
+		Expect(cassette.Episodes).To(HaveLen(2))
+
+		httpsURL, _ := url.Parse(httpsTarget.URL)
+		httpURL, _ := url.Parse(httpTarget.URL)
+		Expect(cassette.Episodes[0].Request.Host).To(Equal(httpsURL.Host))
+		Expect(cassette.Episodes[1].Request.Host).To(Equal(httpURL.Host))
+	})
+
+	It("keeps matching on the host when match_on is reset with a PATCH", func() {
+		configureProxy(map[string]interface{}{"match_on": []string{"method", "path"}})
+
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("http://%s/__betamax__/config", proxyAddress), bytes.NewBufferString(`{"match_on": null}`))
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		var jsonResponse struct {
+			Config map[string]interface{} `json:"config"`
+		}
+		Expect(json.NewDecoder(resp.Body).Decode(&jsonResponse)).To(Succeed())
+		Expect(jsonResponse.Config["match_on"]).To(ContainElement("host"))
+	})
+
+	It("reuses the CA stored on disk", func() {
+		first, err := LoadOrCreateCA(caDir)
+		Expect(err).To(BeNil())
+		second, err := LoadOrCreateCA(caDir)
+		Expect(err).To(BeNil())
+		Expect(first.Certificate.Raw).To(Equal(second.Certificate.Raw))
+	})
+})
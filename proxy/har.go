@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR is an HTTP Archive 1.2 document, as exported by browser devtools.
+// Only the parts betamax can fill in or make use of are modelled.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+	Comment string     `json:"comment,omitempty"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	// name of the route the request was sent through; custom HAR fields
+	// start with an underscore
+	BetamaxTarget string `json:"_betamaxTarget,omitempty"`
+	// the messages of a WebSocket connection, as Chrome saves them
+	WebSocketMessages []HARWebSocketMessage `json:"_webSocketMessages,omitempty"`
+}
+
+type HARWebSocketMessage struct {
+	// "send" for messages from the client, "receive" for messages from the
+	// server
+	Type string `json:"type"`
+	// seconds since the epoch
+	Time float64 `json:"time"`
+	// 1 for text, 2 for base64 encoded binary data
+	Opcode int    `json:"opcode"`
+	Data   string `json:"data"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []HARNameValue `json:"params,omitempty"`
+	Text     string         `json:"text"`
+	// not part of HAR 1.2, which has no way to store binary request bodies;
+	// "base64" if Text is base64 encoded
+	Encoding string `json:"_encoding,omitempty"`
+	// the blob file holding a body too large for the cassette
+	BetamaxBlob string `json:"_betamaxBlob,omitempty"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	// "base64" if Text is base64 encoded
+	Encoding string `json:"encoding,omitempty"`
+	// the blob file holding a body too large for the cassette
+	BetamaxBlob string `json:"_betamaxBlob,omitempty"`
+}
+
+// HARTimings are in milliseconds; -1 marks timings that do not apply
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// CassetteToHAR converts the episodes of a cassette into a HAR document
+// that can be opened in HAR viewers.
+func CassetteToHAR(cassette Cassette) *HAR {
+	har := &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "betamax"},
+		Entries: make([]HAREntry, len(cassette.Episodes)),
+		Comment: cassette.Name,
+	}}
+	now := time.Now()
+	for i, episode := range cassette.Episodes {
+		startedDateTime := episode.RecordedAt
+		if startedDateTime.IsZero() {
+			startedDateTime = now
+		}
+		// betamax only knows the whole round trip, which is mostly waiting
+		// for the response
+		duration := float64(episode.Duration) / float64(time.Millisecond)
+		har.Log.Entries[i] = HAREntry{
+			StartedDateTime: startedDateTime.UTC().Format(time.RFC3339Nano),
+			Time:            duration,
+			Request:         harRequest(&episode.Request),
+			Response:        harResponse(&episode.Response),
+			Timings:         HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: duration},
+			BetamaxTarget:   episode.Request.Target,
+		}
+		for _, message := range episode.WebSocketMessages {
+			har.Log.Entries[i].WebSocketMessages = append(har.Log.Entries[i].WebSocketMessages, harWebSocketMessage(message, startedDateTime))
+		}
+	}
+	return har
+}
+
+// HARToCassette converts the entries of a HAR document, for example one
+// saved from browser devtools, into a cassette the proxy can replay.
+func HARToCassette(name string, har *HAR) (Cassette, error) {
+	cassette := Cassette{Name: name, Episodes: make([]Episode, len(har.Log.Entries))}
+	for i, entry := range har.Log.Entries {
+		request, err := recordedHARRequest(&entry.Request)
+		if err != nil {
+			return Cassette{}, fmt.Errorf("HAR entry %d: %s", i, err)
+		}
+		request.Target = entry.BetamaxTarget
+		response, err := recordedHARResponse(&entry.Response)
+		if err != nil {
+			return Cassette{}, fmt.Errorf("HAR entry %d: %s", i, err)
+		}
+		recordedAt, _ := time.Parse(time.RFC3339Nano, entry.StartedDateTime)
+		cassette.Episodes[i] = Episode{
+			Request:    request,
+			Response:   response,
+			RecordedAt: recordedAt,
+			Duration:   time.Duration(entry.Time * float64(time.Millisecond)),
+		}
+		for _, message := range entry.WebSocketMessages {
+			recorded, err := recordedHARWebSocketMessage(message, recordedAt)
+			if err != nil {
+				return Cassette{}, fmt.Errorf("HAR entry %d: %s", i, err)
+			}
+			cassette.Episodes[i].WebSocketMessages = append(cassette.Episodes[i].WebSocketMessages, recorded)
+		}
+	}
+	return cassette, nil
+}
+
+func harWebSocketMessage(message WebSocketMessage, startedDateTime time.Time) HARWebSocketMessage {
+	sent := startedDateTime.Add(message.Elapsed)
+	harMessage := HARWebSocketMessage{
+		Type:   "receive",
+		Time:   float64(sent.UnixNano()) / float64(time.Second),
+		Opcode: 1,
+		Data:   string(message.Data),
+	}
+	if message.From == FromClient {
+		harMessage.Type = "send"
+	}
+	if message.Binary {
+		harMessage.Opcode = 2
+		harMessage.Data = base64.StdEncoding.EncodeToString(message.Data)
+	}
+	return harMessage
+}
+
+func recordedHARWebSocketMessage(message HARWebSocketMessage, startedDateTime time.Time) (WebSocketMessage, error) {
+	recorded := WebSocketMessage{From: FromServer, Data: []byte(message.Data)}
+	if message.Type == "send" {
+		recorded.From = FromClient
+	}
+	if message.Opcode == 2 {
+		data, err := base64.StdEncoding.DecodeString(message.Data)
+		if err != nil {
+			return WebSocketMessage{}, err
+		}
+		recorded.Binary, recorded.Data = true, data
+	}
+	if !startedDateTime.IsZero() && message.Time > 0 {
+		sent := time.Unix(0, int64(message.Time*float64(time.Second)))
+		if elapsed := sent.Sub(startedDateTime); elapsed > 0 {
+			recorded.Elapsed = elapsed
+		}
+	}
+	return recorded, nil
+}
+
+func harRequest(r *RecordedRequest) HARRequest {
+	request := HARRequest{
+		Method:      r.Method,
+		URL:         r.absoluteURL(),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(r.Header),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(r.Body),
+	}
+	if r.URL != nil {
+		request.QueryString = harValues(r.URL.Query())
+	}
+	if len(r.Body) > 0 || r.BodyBlob != "" {
+		text, encoding := harText(r.Body)
+		request.PostData = &HARPostData{
+			MimeType:    r.Header.Get("Content-Type"),
+			Text:        text,
+			Encoding:    encoding,
+			BetamaxBlob: r.BodyBlob,
+		}
+		if form, _ := peekPostForm(r.httpRequest()); len(form) > 0 && encoding == "" {
+			request.PostData.Params = harValues(form)
+		}
+	}
+	return request
+}
+
+func harResponse(r *RecordedResponse) HARResponse {
+	header := http.Header{}
+	for key, values := range r.Header {
+		header[key] = values
+	}
+	if r.ContentEncoding != "" {
+		// HAR content is always decoded, but the headers show how it was sent
+		header.Set("Content-Encoding", r.ContentEncoding)
+	}
+	text, encoding := harText(r.Body)
+	return HARResponse{
+		Status:      r.StatusCode,
+		StatusText:  http.StatusText(r.StatusCode),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(header),
+		Content: HARContent{
+			Size:        len(r.Body),
+			MimeType:    r.Header.Get("Content-Type"),
+			Text:        text,
+			Encoding:    encoding,
+			BetamaxBlob: r.BodyBlob,
+		},
+		RedirectURL: r.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+}
+
+func recordedHARRequest(r *HARRequest) (RecordedRequest, error) {
+	uri, err := url.Parse(r.URL)
+	if err != nil {
+		return RecordedRequest{}, err
+	}
+	body := []byte{}
+	blob := ""
+	if r.PostData != nil {
+		if body, err = harBody(r.PostData.Text, r.PostData.Encoding); err != nil {
+			return RecordedRequest{}, err
+		}
+		blob = r.PostData.BetamaxBlob
+	}
+
+	request := RecordedRequest{
+		Method:   r.Method,
+		Host:     uri.Host,
+		URL:      uri,
+		Header:   recordedHARHeader(r.Headers),
+		Body:     body,
+		BodyBlob: blob,
+	}
+	request.Form, _ = peekForm(request.httpRequest())
+	return request, nil
+}
+
+func recordedHARResponse(r *HARResponse) (RecordedResponse, error) {
+	body, err := harBody(r.Content.Text, r.Content.Encoding)
+	if err != nil {
+		return RecordedResponse{}, err
+	}
+	response := RecordedResponse{
+		StatusCode: r.Status,
+		Header:     recordedHARHeader(r.Headers),
+		Body:       body,
+		BodyBlob:   r.Content.BetamaxBlob,
+	}
+	// HAR content is decoded already; store it the way decodeResponse does
+	if encoding := response.Header.Get("Content-Encoding"); encoding != "" {
+		response.ContentEncoding = strings.ToLower(encoding)
+		response.Header.Del("Content-Encoding")
+		response.Header.Del("Content-Length")
+	}
+	return response, nil
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	return harValues(map[string][]string(header))
+}
+
+func harValues(values map[string][]string) []HARNameValue {
+	pairs := []HARNameValue{}
+	for _, name := range sortedKeys(values) {
+		for _, value := range values[name] {
+			pairs = append(pairs, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+func sortedKeys(values map[string][]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func recordedHARHeader(pairs []HARNameValue) http.Header {
+	header := http.Header{}
+	for _, pair := range pairs {
+		// HTTP/2 pseudo headers like :authority
+		if strings.HasPrefix(pair.Name, ":") {
+			continue
+		}
+		header.Add(pair.Name, pair.Value)
+	}
+	return header
+}
+
+func harText(body []byte) (text string, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harBody(text string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(text), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return nil, fmt.Errorf("unknown content encoding %q", encoding)
+}
+
+// makes HAR files usable as cassettes, so traffic captured in a browser can
+// be replayed by dropping the file into the cassette directory
+type harFormat struct{}
+
+func (harFormat) Extensions() []string {
+	return []string{".har"}
+}
+
+func (harFormat) Marshal(cassette Cassette) ([]byte, error) {
+	return json.MarshalIndent(CassetteToHAR(cassette), "", "  ")
+}
+
+func (harFormat) Unmarshal(data []byte) (Cassette, error) {
+	har := HAR{}
+	if err := json.Unmarshal(data, &har); err != nil {
+		return Cassette{}, err
+	}
+	return HARToCassette(har.Log.Comment, &har)
+}
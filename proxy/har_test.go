@@ -0,0 +1,167 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/thegreatape/betamax/proxy"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+var _ = Describe("HAR", func() {
+	chromeHAR := `{
+  "log": {
+    "version": "1.2",
+    "creator": {"name": "WebInspector", "version": "537.36"},
+    "pages": [],
+    "entries": [
+      {
+        "startedDateTime": "2020-05-04T10:00:00.000Z",
+        "time": 42.5,
+        "request": {
+          "method": "POST",
+          "url": "https://api.example.com/login?next=%2Fhome",
+          "httpVersion": "http/2.0",
+          "headers": [
+            {"name": ":authority", "value": "api.example.com"},
+            {"name": "content-type", "value": "application/x-www-form-urlencoded"}
+          ],
+          "queryString": [{"name": "next", "value": "/home"}],
+          "cookies": [],
+          "headersSize": -1,
+          "bodySize": 17,
+          "postData": {
+            "mimeType": "application/x-www-form-urlencoded",
+            "text": "user=bob&pass=123",
+            "params": [{"name": "user", "value": "bob"}, {"name": "pass", "value": "123"}]
+          }
+        },
+        "response": {
+          "status": 200,
+          "statusText": "",
+          "httpVersion": "http/2.0",
+          "headers": [
+            {"name": "content-type", "value": "application/octet-stream"},
+            {"name": "content-encoding", "value": "gzip"}
+          ],
+          "cookies": [],
+          "content": {"size": 4, "mimeType": "application/octet-stream", "text": "3q2+7w==", "encoding": "base64"},
+          "redirectURL": "",
+          "headersSize": -1,
+          "bodySize": 24
+        },
+        "cache": {},
+        "timings": {"blocked": 1, "dns": -1, "ssl": -1, "connect": -1, "send": 0.5, "wait": 40, "receive": 1}
+      }
+    ]
+  }
+}`
+
+	It("converts HAR entries from browser devtools into episodes", func() {
+		var har HAR
+		Expect(json.Unmarshal([]byte(chromeHAR), &har)).To(Succeed())
+
+		cassette, err := HARToCassette("login", &har)
+		Expect(err).To(BeNil())
+		Expect(cassette.Name).To(Equal("login"))
+		Expect(cassette.Episodes).To(HaveLen(1))
+
+		request := cassette.Episodes[0].Request
+		Expect(request.Method).To(Equal("POST"))
+		Expect(request.Host).To(Equal("api.example.com"))
+		Expect(request.URL.Path).To(Equal("/login"))
+		Expect(request.Header).To(Equal(http.Header{"Content-Type": []string{"application/x-www-form-urlencoded"}}))
+		Expect(string(request.Body)).To(Equal("user=bob&pass=123"))
+		Expect(request.Form["user"]).To(Equal([]string{"bob"}))
+
+		response := cassette.Episodes[0].Response
+		Expect(response.StatusCode).To(Equal(200))
+		Expect(response.Body).To(Equal([]byte{0xde, 0xad, 0xbe, 0xef}))
+		Expect(response.ContentEncoding).To(Equal("gzip"))
+		Expect(response.Header.Get("Content-Encoding")).To(BeEmpty())
+	})
+
+	It("converts episodes into HAR entries", func() {
+		episode := Episode{
+			Request: RecordedRequest{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Path: "/search", RawQuery: "q=cats"},
+				Header: http.Header{"Accept": []string{"application/json"}},
+			},
+			Response: RecordedResponse{
+				StatusCode:      200,
+				Header:          http.Header{"Content-Type": []string{"image/png"}},
+				Body:            []byte{0x89, 0x50, 0x4e, 0x47, 0xff},
+				ContentEncoding: "br",
+			},
+		}
+
+		har := CassetteToHAR(Cassette{Name: "search", Episodes: []Episode{episode}})
+		Expect(har.Log.Version).To(Equal("1.2"))
+		Expect(har.Log.Entries).To(HaveLen(1))
+
+		entry := har.Log.Entries[0]
+		Expect(entry.Request.URL).To(Equal("http://localhost:8080/search?q=cats"))
+		Expect(entry.Request.QueryString).To(Equal([]HARNameValue{{Name: "q", Value: "cats"}}))
+		Expect(entry.Request.Headers).To(Equal([]HARNameValue{{Name: "Accept", Value: "application/json"}}))
+		Expect(entry.Request.PostData).To(BeNil())
+		Expect(entry.Response.Status).To(Equal(200))
+		Expect(entry.Response.StatusText).To(Equal("OK"))
+		Expect(entry.Response.Headers).To(ContainElement(HARNameValue{Name: "Content-Encoding", Value: "br"}))
+		Expect(entry.Response.Content.Encoding).To(Equal("base64"))
+		Expect(entry.Response.Content.Text).To(Equal("iVBOR/8="))
+
+		cassette, err := HARToCassette("search", har)
+		Expect(err).To(BeNil())
+		Expect(cassette.Episodes[0].Response).To(Equal(episode.Response))
+	})
+
+	It("keeps WebSocket messages as Chrome does", func() {
+		recordedAt := time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+		episode := Episode{
+			Request:    RecordedRequest{Method: "GET", Host: "localhost", URL: &url.URL{Path: "/socket"}},
+			Response:   RecordedResponse{StatusCode: 101},
+			RecordedAt: recordedAt,
+			WebSocketMessages: []WebSocketMessage{
+				{From: FromClient, Data: []byte("ping"), Elapsed: 10 * time.Millisecond},
+				{From: FromServer, Binary: true, Data: []byte{0xde, 0xad}, Elapsed: 20 * time.Millisecond},
+			},
+		}
+
+		har := CassetteToHAR(Cassette{Episodes: []Episode{episode}})
+		messages := har.Log.Entries[0].WebSocketMessages
+		Expect(messages).To(HaveLen(2))
+		Expect(messages[0]).To(Equal(HARWebSocketMessage{Type: "send", Time: 1588586400.01, Opcode: 1, Data: "ping"}))
+		Expect(messages[1].Type).To(Equal("receive"))
+		Expect(messages[1].Opcode).To(Equal(2))
+		Expect(messages[1].Data).To(Equal("3q0="))
+
+		cassette, err := HARToCassette("socket", har)
+		Expect(err).To(BeNil())
+		Expect(cassette.Episodes[0].WebSocketMessages).To(HaveLen(2))
+		Expect(cassette.Episodes[0].WebSocketMessages[1].Binary).To(BeTrue())
+		Expect(cassette.Episodes[0].WebSocketMessages[1].Data).To(Equal([]byte{0xde, 0xad}))
+		Expect(cassette.Episodes[0].WebSocketMessages[1].Elapsed).To(BeNumerically("~", 20*time.Millisecond, time.Millisecond))
+	})
+
+	It("loads HAR files from the cassette directory as cassettes", func() {
+		cassetteDir, _ := ioutil.TempDir("", "betamax-har")
+		defer os.RemoveAll(cassetteDir)
+		ioutil.WriteFile(path.Join(cassetteDir, "login.har"), []byte(chromeHAR), 0700)
+
+		config := Config{Cassette: "login", CassetteDir: cassetteDir}
+		Expect(config.Load()).To(Succeed())
+		Expect(config.CassetteFormat).To(BeEmpty())
+		Expect(config.Save()).To(Succeed())
+		_, err := os.Stat(path.Join(cassetteDir, "login.json"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		Expect(config.Episodes).To(HaveLen(1))
+		Expect(config.Episodes[0].Request.URL.String()).To(Equal("https://api.example.com/login?next=%2Fhome"))
+	})
+})
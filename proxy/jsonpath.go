@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// one step of a JSONPath-style expression such as $.items[*].id or $..nonce
+type jsonPathStep struct {
+	key      string
+	index    int
+	wildcard bool
+	// whether the step applies at any depth below the current node (..)
+	recursive bool
+}
+
+// parses the subset of JSONPath that makes sense for ignoring fields:
+// $ for the root, .name or ['name'] for object members, [n] for array
+// elements, * for everything at one level, and ..name for any depth.
+// the leading $ may be left out.
+func parseJSONPath(expr string) ([]jsonPathStep, error) {
+	rest := strings.TrimPrefix(expr, "$")
+	if rest != "" && rest[0] != '.' && rest[0] != '[' {
+		rest = "." + rest
+	}
+
+	steps := []jsonPathStep{}
+	for rest != "" {
+		step := jsonPathStep{index: -1}
+		if strings.HasPrefix(rest, "..") {
+			step.recursive = true
+			// leave a single . so the member is parsed like any other,
+			// or none if a bracket selector follows
+			rest = strings.TrimPrefix(rest[1:], ".[")
+			if rest != "" && rest[0] != '.' {
+				rest = "[" + rest
+			}
+		}
+
+		switch {
+		case rest == "":
+			return nil, fmt.Errorf("invalid json path %q: nothing after ..", expr)
+		case rest[0] == '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			step.key, rest = rest[:end], rest[end:]
+			if step.key == "*" {
+				step.key, step.wildcard = "", true
+			}
+			if step.key == "" && !step.wildcard {
+				return nil, fmt.Errorf("invalid json path %q: empty member name", expr)
+			}
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid json path %q: unterminated [", expr)
+			}
+			selector := rest[1:end]
+			rest = rest[end+1:]
+
+			if selector == "*" {
+				step.wildcard = true
+			} else if unquoted := strings.Trim(selector, `'"`); len(selector) >= 2 && unquoted != selector {
+				step.key = unquoted
+			} else if index, err := strconv.Atoi(selector); err == nil && index >= 0 {
+				step.index = index
+			} else {
+				return nil, fmt.Errorf("invalid json path %q: bad selector [%s]", expr, selector)
+			}
+		default:
+			return nil, fmt.Errorf("invalid json path %q", expr)
+		}
+
+		steps = append(steps, step)
+	}
+
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("invalid json path %q: it selects the whole document", expr)
+	}
+	return steps, nil
+}
+
+// removes everything the path selects from a document decoded with
+// encoding/json. array elements are replaced with nil rather than removed,
+// so the positions of the remaining elements don't change.
+func deleteJSONPath(node interface{}, steps []jsonPathStep) {
+	rewriteJSONPath(node, steps, func(interface{}) (interface{}, bool) {
+		return nil, false
+	})
+}
+
+// replaces everything the path selects with the result of rewrite, or
+// removes it if rewrite returns false.
+func rewriteJSONPath(node interface{}, steps []jsonPathStep, rewrite func(interface{}) (interface{}, bool)) {
+	if len(steps) == 0 {
+		return
+	}
+	step, last := steps[0], len(steps) == 1
+
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if step.wildcard || (step.key != "" && step.key == key) {
+				if last {
+					if replacement, ok := rewrite(child); ok {
+						value[key] = replacement
+					} else {
+						delete(value, key)
+					}
+					continue
+				}
+				rewriteJSONPath(child, steps[1:], rewrite)
+			}
+			if step.recursive {
+				rewriteJSONPath(child, steps, rewrite)
+			}
+		}
+	case []interface{}:
+		for i, child := range value {
+			if step.wildcard || step.index == i {
+				if last {
+					value[i], _ = rewrite(child)
+					continue
+				}
+				rewriteJSONPath(child, steps[1:], rewrite)
+			}
+			if step.recursive {
+				rewriteJSONPath(child, steps, rewrite)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Latency slows down replayed episodes, to reproduce the timeouts and slow
+// paths that instantly replayed responses hide. The delays add up.
+type Latency struct {
+	// wait as long as the upstream took when the episode was recorded
+	Recorded bool `json:"recorded"`
+	// fixed delay before the response, in milliseconds
+	DelayMs int `json:"delay_ms"`
+	// random extra delay of up to this many milliseconds
+	JitterMs int `json:"jitter_ms"`
+	// send the body at no more than this many bytes per second; zero
+	// sends it at once
+	BytesPerSecond int `json:"bytes_per_second"`
+}
+
+// LatencyRule applies its latency to replayed requests whose URL matches
+// URLPattern, instead of the config's global latency.
+type LatencyRule struct {
+	// regular expression matched against the full request URL, like
+	// http://example.com/path?query
+	URLPattern string `json:"url_pattern"`
+	Latency
+
+	// URLPattern, compiled by validate
+	urlPattern *regexp.Regexp
+}
+
+func (l *Latency) validate() error {
+	if l.DelayMs < 0 || l.JitterMs < 0 || l.BytesPerSecond < 0 {
+		return fmt.Errorf("latency settings must not be negative")
+	}
+	return nil
+}
+
+func (r *LatencyRule) validate() error {
+	urlPattern, err := regexp.Compile(r.URLPattern)
+	if err != nil {
+		return err
+	}
+	r.urlPattern = urlPattern
+	return r.Latency.validate()
+}
+
+func (r *LatencyRule) matches(url string) bool {
+	if r.urlPattern == nil {
+		// a rule set up in Go rather than through JSON was never validated
+		matched, err := regexp.MatchString(r.URLPattern, url)
+		return err == nil && matched
+	}
+	return r.urlPattern.MatchString(url)
+}
+
+// the latency for a replayed request: that of the first rule matching its
+// URL, or the global one
+func (c *Config) latencyFor(req *http.Request) Latency {
+	url := requestURL(req)
+	for i := range c.LatencyRules {
+		if c.LatencyRules[i].matches(url) {
+			return c.LatencyRules[i].Latency
+		}
+	}
+	return c.Latency
+}
+
+func (l Latency) delay(episode *Episode) time.Duration {
+	delay := time.Duration(l.DelayMs) * time.Millisecond
+	if l.Recorded {
+		delay += episode.Duration
+	}
+	if l.JitterMs > 0 {
+		delay += time.Duration(rand.Int63n(int64(l.JitterMs)*int64(time.Millisecond) + 1))
+	}
+	return delay
+}
+
+// waits out the delay before a response, giving up early if the client
+// goes away. returns false if it did.
+func (l Latency) wait(episode *Episode, req *http.Request) bool {
+	delay := l.delay(episode)
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+// how often a throttled body is written
+const throttleTick = 100 * time.Millisecond
+
+// copies body to the response, throttled to the configured bandwidth
+func (l Latency) write(resp http.ResponseWriter, req *http.Request, body io.Reader) {
+	if l.BytesPerSecond <= 0 {
+		io.Copy(resp, body)
+		return
+	}
+
+	chunk := int(int64(l.BytesPerSecond) * int64(throttleTick) / int64(time.Second))
+	if chunk < 1 {
+		chunk = 1
+	}
+	interval := time.Duration(chunk) * time.Second / time.Duration(l.BytesPerSecond)
+	flusher, _ := resp.(http.Flusher)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	buf := make([]byte, chunk)
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			if _, err := resp.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// replays a streamed body chunk by chunk, flushing each one as far into
+// the response as it was recorded, divided by speed
+func (l Latency) stream(resp http.ResponseWriter, req *http.Request, body io.Reader, chunks []Chunk, speed float64) {
+	if speed <= 0 {
+		speed = 1
+	}
+	flusher, _ := resp.(http.Flusher)
+
+	start := time.Now()
+	for _, chunk := range chunks {
+		at := time.Duration(float64(chunk.Elapsed) / speed)
+		if wait := at - time.Since(start); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		l.write(resp, req, io.LimitReader(body, int64(chunk.Size)))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	// whatever the chunks don't account for
+	l.write(resp, req, body)
+}
+
+// the URL a request was sent to, with scheme and host even for requests
+// to the reverse proxy, which only carry a path
+func requestURL(req *http.Request) string {
+	recorded := RecordedRequest{Host: req.Host, URL: req.URL}
+	return recorded.absoluteURL()
+}
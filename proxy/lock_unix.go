@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"os"
+	"syscall"
+)
+
+// takes an advisory lock on dir, shared or exclusive, which is held until
+// the returned function is called. locks are per open file, so they
+// serialize goroutines of one process as well as separate processes.
+func lockDir(dir string, exclusive bool) (unlock func(), err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package proxy
+
+import "os"
+
+// directory locks are not supported on windows; cassette writes are still
+// atomic, but concurrent betamax processes are not serialized.
+func lockDir(dir string, exclusive bool) (unlock func(), err error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return func() {}, nil
+}
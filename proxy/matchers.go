@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+)
+
+// Matcher decides whether a request matches a recorded one in one
+// particular respect. A request replays an episode only if every matcher
+// named in the config's match_on list matches.
+type Matcher interface {
+	Match(recorded *RecordedRequest, req *http.Request, config *Config) bool
+}
+
+// MatcherFunc lets an ordinary function be used as a Matcher.
+type MatcherFunc func(recorded *RecordedRequest, req *http.Request, config *Config) bool
+
+func (f MatcherFunc) Match(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+	return f(recorded, req, config)
+}
+
+// the matchers used when the config does not name any
+var DefaultMatchOn = []string{"target", "method", "path", "query", "headers", "body"}
+
+var (
+	matchersMu sync.RWMutex
+	matchers   = map[string]Matcher{
+		"target":    MatcherFunc(matchTarget),
+		"method":    MatcherFunc(matchMethod),
+		"host":      MatcherFunc(matchHost),
+		"path":      MatcherFunc(matchPath),
+		"query":     MatcherFunc(matchQuery),
+		"headers":   MatcherFunc(matchHeaders),
+		"body":      MatcherFunc(matchBody),
+		"json_body": MatcherFunc(matchJSONBody),
+		"form":      MatcherFunc(matchForm),
+	}
+)
+
+// RegisterMatcher makes a matcher available under name for use in
+// match_on, replacing any matcher already registered under that name.
+func RegisterMatcher(name string, matcher Matcher) {
+	matchersMu.Lock()
+	defer matchersMu.Unlock()
+	matchers[name] = matcher
+}
+
+func lookupMatcher(name string) (Matcher, error) {
+	matchersMu.RLock()
+	defer matchersMu.RUnlock()
+	matcher, ok := matchers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown matcher %q", name)
+	}
+	return matcher, nil
+}
+
+// compares the routes the requests were sent through
+func matchTarget(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+	return recorded.Target == requestTarget(req)
+}
+
+func matchMethod(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+	return recorded.Method == req.Method
+}
+
+func matchHost(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+	return recorded.Host == req.Host
+}
+
+func matchPath(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+	return recorded.URL.Path == req.URL.Path && recorded.URL.Fragment == req.URL.Fragment
+}
+
+// compares the parsed query parameters regardless of their order, leaving
+// out those in the config's ignore_query_params and, if match_query_params
+// is set, all but the ones it names. repeated parameters must have their
+// values in the same order.
+func matchQuery(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+	recordedQuery, recordedErr := url.ParseQuery(recorded.URL.RawQuery)
+	requestQuery, requestErr := url.ParseQuery(req.URL.RawQuery)
+	if recordedErr != nil || requestErr != nil {
+		return recorded.URL.RawQuery == req.URL.RawQuery
+	}
+
+	return reflect.DeepEqual(filterQuery(recordedQuery, config), filterQuery(requestQuery, config))
+}
+
+func filterQuery(query url.Values, config *Config) url.Values {
+	filtered := url.Values{}
+	for key, values := range query {
+		if len(config.MatchQueryParams) > 0 && !contains(config.MatchQueryParams, key) {
+			continue
+		}
+		if contains(config.IgnoreQueryParams, key) {
+			continue
+		}
+		filtered[key] = values
+	}
+	return filtered
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// compares the headers listed in the config's match_headers
+func matchHeaders(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+	for _, header := range config.MatchHeaders {
+		for i, _ := range req.Header[header] {
+			if len(req.Header[header]) != len(recorded.Header[header]) {
+				return false
+			}
+
+			if req.Header[header][i] != recorded.Header[header][i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compares the fields of form submissions, so that things like multipart
+// boundaries don't matter, and the raw bytes of any other body
+func matchBody(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+	// bodies too large to hold in memory are compared by their hashes
+	if recorded.BodyBlob != "" || requestBlob(req) != "" {
+		return recorded.BodyBlob == requestBlob(req)
+	}
+
+	form, _ := peekPostForm(req)
+	if len(form) != 0 {
+		return matchForm(recorded, req, config)
+	}
+
+	body, _ := peekBytes(req)
+	return bytes.Compare(recorded.Body, body) == 0
+}
+
+// compares the form fields submitted in the bodies. query parameters are
+// left to the query matcher.
+func matchForm(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+	form, _ := peekPostForm(req)
+	recordedForm, _ := peekPostForm(recorded.httpRequest())
+
+	for key, _ := range form {
+		if len(recordedForm[key]) != len(form[key]) {
+			return false
+		}
+
+		for i, _ := range form[key] {
+			if recordedForm[key][i] != form[key][i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compares bodies with a JSON content type as JSON documents, ignoring key
+// order, whitespace and the fields selected by the config's
+// ignore_json_paths. other bodies are compared like the body matcher does.
+func matchJSONBody(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+	if !IsJSON(recorded.Header) || !IsJSON(req.Header) || recorded.BodyBlob != "" || requestBlob(req) != "" {
+		return matchBody(recorded, req, config)
+	}
+
+	body, _ := peekBytes(req)
+	recordedJSON, recordedErr := normalizedJSON(recorded.Body, config.IgnoreJSONPaths)
+	requestJSON, requestErr := normalizedJSON(body, config.IgnoreJSONPaths)
+	if recordedErr != nil || requestErr != nil {
+		return bytes.Compare(recorded.Body, body) == 0
+	}
+	return reflect.DeepEqual(recordedJSON, requestJSON)
+}
+
+// decodes a JSON document and strips the ignored paths from it
+func normalizedJSON(data []byte, ignorePaths []string) (interface{}, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	for _, expr := range ignorePaths {
+		steps, err := parseJSONPath(expr)
+		if err != nil {
+			return nil, err
+		}
+		deleteJSONPath(doc, steps)
+	}
+	return doc, nil
+}
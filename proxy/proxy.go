@@ -2,72 +2,197 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
-func handleConfigRequest(resp http.ResponseWriter, req *http.Request, config *Config) {
-	if req.Method == "GET" {
-		json.NewEncoder(resp).Encode(config)
-	} else if req.Method == "POST" {
-		json.NewDecoder(req.Body).Decode(config)
-		config.Load()
+// GET returns the configuration. POST and PATCH update the settings given
+// in the body and leave the others alone; PATCH also resets the settings
+// given as null to the values the proxy started with. Both answer with the resulting
+// configuration and the number of episodes in the cassette.
+func handleConfigRequest(resp http.ResponseWriter, req *http.Request, store *store) {
+	switch req.Method {
+	case "GET":
+		writeJSON(resp, store.Config())
+	case "POST", "PATCH":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			jsonError(resp, err.Error(), 400)
+			return
+		}
+		if req.Method == "PATCH" {
+			if body, err = resetNullSettings(body, store.defaults); err != nil {
+				jsonError(resp, err.Error(), 400)
+				return
+			}
+		}
+
+		status := 400
+		err = store.update(func(config *Config) error {
+			if err := json.Unmarshal(body, config); err != nil {
+				return err
+			}
+			// a missing cassette is simply a new one
+			if err := config.Load(); err != nil && !os.IsNotExist(err) {
+				status = 500
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			jsonError(resp, err.Error(), status)
+			return
+		}
+		config := store.Config()
+		writeJSON(resp, map[string]interface{}{"config": config, "episodes": len(config.Episodes)})
+	default:
+		resp.Header().Set("Allow", "GET, POST, PATCH")
+		jsonError(resp, fmt.Sprintf("method %s not allowed", req.Method), 405)
+	}
+}
+
+// replaces the settings given as null in a config payload with their
+// values in config, the one the proxy started with
+func resetNullSettings(body []byte, config *Config) ([]byte, error) {
+	settings := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &settings); err != nil {
+		return nil, err
 	}
+	defaults := map[string]json.RawMessage{}
+	data, _ := json.Marshal(config)
+	json.Unmarshal(data, &defaults)
+
+	for name, value := range settings {
+		if string(value) != "null" {
+			continue
+		}
+		if value, ok := defaults[name]; ok {
+			settings[name] = value
+		}
+	}
+	return json.Marshal(settings)
 }
 
-func configHandler(handler http.Handler, config *Config) http.Handler {
+// answers with an error as {"error": message}
+func jsonError(resp http.ResponseWriter, message string, status int) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(map[string]string{"error": message})
+}
+
+func configHandler(handler http.Handler, store *store) http.Handler {
 	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/__betamax__/config" {
-			handleConfigRequest(resp, req, config)
+			handleConfigRequest(resp, req, store)
+		} else if req.URL.Path == "/__betamax__/targets" {
+			handleTargetsRequest(resp, req, store)
+		} else if req.URL.Path == cassettesPath || strings.HasPrefix(req.URL.Path, cassettesPath+"/") {
+			handleCassettesRequest(resp, req, store)
 		} else {
 			handler.ServeHTTP(resp, req)
 		}
 	})
 }
 
-func cassetteHandler(handler http.Handler, config *Config) http.Handler {
+func cassetteHandler(handler http.Handler, store *store) http.Handler {
 	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		config := store.Config()
 		if config.Cassette == "" {
 			handler.ServeHTTP(resp, req)
 			return
 		}
 
-		if episode := findEpisode(req, config); config.RecordNewEpisodes && episode != nil {
-			serveEpisode(episode, resp)
-		} else {
-			if !config.DenyUnrecordedRequests {
-				serveAndRecord(resp, req, handler, config)
-			} else {
-				resp.WriteHeader(403)
+		if !config.RecordMode.Valid() && config.RecordMode != "" {
+			http.Error(resp, fmt.Sprintf("betamax: unknown record mode %q", config.RecordMode), 500)
+			return
+		}
+
+		if websocket.IsWebSocketUpgrade(req) {
+			serveWebSocket(resp, req, store, config)
+			return
+		}
+
+		if config.blobThreshold() > 0 {
+			var spooled *spooledBody
+			var err error
+			if req, spooled, err = spoolRequestBody(req, config); err != nil {
+				http.Error(resp, fmt.Sprintf("betamax: reading request body failed: %s", err), 500)
+				return
+			}
+			if spooled != nil {
+				defer spooled.blob.discard()
 			}
 		}
+
+		if config.replaysEpisodes() {
+			if episode, index := store.playEpisode(req, config); episode != nil {
+				if config.expired(episode) && reRecord(resp, req, handler, store, config, index) {
+					return
+				}
+				serveEpisode(episode, resp, req, config)
+				return
+			}
+		}
+
+		if config.recordsNewEpisodes() {
+			serveAndRecord(resp, req, handler, store, config)
+		} else {
+			denyRequest(resp, req, config)
+		}
 	})
 }
 
-func rewriteHeaderHandler(handler http.Handler, config *Config) http.Handler {
+// refuses a request that has no recorded episode, explaining why so the
+// failure is easy to track down from the client's side
+func denyRequest(resp http.ResponseWriter, req *http.Request, config *Config) {
+	resp.Header().Set("X-Betamax-Denied", "true")
+	http.Error(resp,
+		fmt.Sprintf("betamax: no recorded episode in cassette %q is left for %s %s and record mode %q does not allow recording it",
+			config.Cassette, req.Method, req.URL.RequestURI(), config.RecordMode),
+		403)
+}
+
+func rewriteHeaderHandler(handler http.Handler, store *store) http.Handler {
 	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-		if config.RewriteHostHeader {
-			req.Host = config.TargetHost
+		if config := store.Config(); config.RewriteHostHeader {
+			if route := requestRoute(req); route != nil {
+				req.Host = route.targetHost()
+			} else {
+				req.Host = config.TargetHost
+			}
 		}
 
 		handler.ServeHTTP(resp, req)
 	})
 }
 
-// reads all bytes of the request into memory
-// returns the read bytes and replaces the request's Reader
-// with a refilled reader. seems like there should be a better
-// way to do this.
+// reads the body of req and puts it back to be read again. bodies spooled
+// to a blob file are left alone, and read as empty.
 func peekBytes(req *http.Request) (body []byte, err error) {
+	if requestSpooledBody(req) != nil {
+		return nil, nil
+	}
 	body, err = ioutil.ReadAll(req.Body)
 	req.Body = ioutil.NopCloser(bytes.NewReader(body))
 	return
 }
 
 func peekForm(req *http.Request) (form url.Values, err error) {
+	if requestSpooledBody(req) != nil {
+		return req.URL.Query(), nil
+	}
 	body, err := ioutil.ReadAll(req.Body)
 	req.Body = ioutil.NopCloser(bytes.NewReader(body))
 
@@ -77,74 +202,133 @@ func peekForm(req *http.Request) (form url.Values, err error) {
 	return
 }
 
-func sameURL(a *url.URL, b *url.URL) bool {
-	return a.Path == b.Path && a.RawQuery == b.RawQuery && a.Fragment == b.Fragment
+// like peekForm, but only the form fields from the body, without the
+// query parameters
+func peekPostForm(req *http.Request) (form url.Values, err error) {
+	_, err = peekForm(req)
+	form = req.PostForm
+	return
 }
 
-func sameHeaders(recorded http.Header, newRequest http.Header, config Config) bool {
-	for _, header := range config.MatchHeaders {
-		for i, _ := range newRequest[header] {
-			if len(newRequest[header]) != len(recorded[header]) {
-				return false
-			}
+func sameRequest(a *RecordedRequest, b *http.Request, config Config) bool {
+	matchOn := config.MatchOn
+	if len(matchOn) == 0 {
+		matchOn = DefaultMatchOn
+	}
 
-			if newRequest[header][i] != recorded[header][i] {
-				return false
-			}
+	for _, name := range matchOn {
+		matcher, err := lookupMatcher(name)
+		if err != nil || !matcher.Match(a, b, &config) {
+			return false
 		}
 	}
 	return true
 }
 
-func sameRequest(a *RecordedRequest, b *http.Request, config Config) bool {
-	if a.Method != b.Method {
-		return false
+func serveAndRecord(resp http.ResponseWriter, req *http.Request, handler http.Handler, store *store, config *Config) {
+	proxyWriter := ProxyResponseWriter{Writer: resp}
+	// re-recording replaces the old episode instead of piling up duplicates
+	replace := store.replacedEpisode(req, config)
+	episode := proxyEpisode(&proxyWriter, req, handler, config)
+	if upstreamFailed(req) {
+		return
 	}
+	store.writeEpisode(config.Cassette, episode, replace)
+}
 
-	if !sameURL(a.URL, b.URL) {
+// proxies a request whose episode, at index replace, has expired and
+// replaces the episode with the new recording. the response is held back
+// until the upstream has answered, so that if it could not be reached,
+// nothing has been written and the caller can fall back to the expired
+// episode.
+func reRecord(resp http.ResponseWriter, req *http.Request, handler http.Handler, store *store, config *Config, replace int) bool {
+	req = req.WithContext(context.WithValue(req.Context(), upstreamFailedKey{}, new(bool)))
+	proxyWriter := ProxyResponseWriter{Writer: &discardResponseWriter{header: http.Header{}}}
+	episode := proxyEpisode(&proxyWriter, req, handler, config)
+	if upstreamFailed(req) {
+		log.Printf("betamax: upstream unreachable, replaying expired episode for %s %s", req.Method, req.URL)
 		return false
 	}
 
-	if !sameHeaders(a.Header, b.Header, config) {
-		return false
+	store.writeEpisode(config.Cassette, episode, replace)
+	for key, values := range proxyWriter.Response.Header {
+		resp.Header()[key] = values
 	}
+	resp.WriteHeader(proxyWriter.Response.StatusCode)
+	if name := proxyWriter.Response.BodyBlob; name != "" {
+		if file, err := os.Open(config.blobPath(name)); err == nil {
+			io.Copy(resp, file)
+			file.Close()
+		}
+	} else {
+		resp.Write(proxyWriter.Response.Body)
+	}
+	return true
+}
 
-	form, _ := peekForm(b)
+// proxies req through handler, writing the response to proxyWriter, and
+// returns the episode to record
+func proxyEpisode(proxyWriter *ProxyResponseWriter, req *http.Request, handler http.Handler, config *Config) Episode {
+	recordedRequest := recordRequest(req)
+	proxyWriter.BlobThreshold = config.blobThreshold()
+	proxyWriter.BlobDir = config.blobDir()
 
-	for key, _ := range form {
-		if len(a.Form[key]) != len(form[key]) {
-			return false
-		}
+	start := time.Now()
+	handler.ServeHTTP(proxyWriter, req)
+	duration := time.Since(start)
 
-		for i, _ := range form[key] {
-			if a.Form[key][i] != form[key][i] {
-				return false
-			}
+	// the blobs of large bodies are kept once they have been sent in full
+	if spooled := requestSpooledBody(req); spooled != nil {
+		name, err := spooled.blob.commit()
+		if err != nil {
+			log.Printf("betamax: storing request body failed: %s", err)
 		}
+		recordedRequest.BodyBlob = name
+	}
+	if err := proxyWriter.finish(); err != nil {
+		log.Printf("betamax: storing response body failed: %s", err)
 	}
 
-	if len(form) == 0 {
-		body, _ := peekBytes(b)
-		if bytes.Compare(a.Body, body) != 0 {
-			return false
-		}
+	return Episode{
+		Request:    config.Redact.redactRequest(recordedRequest),
+		Response:   config.Redact.redactResponse(decodeResponse(proxyWriter.Response)),
+		RecordedAt: start.UTC(),
+		Duration:   duration,
 	}
+}
 
-	return true
+type upstreamFailedKey struct{}
+
+// whether upstreamErrorHandler flagged req, for callers that asked it to
+// by putting a flag into the request's context
+func upstreamFailed(req *http.Request) bool {
+	failed, ok := req.Context().Value(upstreamFailedKey{}).(*bool)
+	return ok && *failed
 }
 
-func serveAndRecord(resp http.ResponseWriter, req *http.Request, handler http.Handler, config *Config) {
-	proxyWriter := ProxyResponseWriter{Writer: resp}
-	recordedRequest := recordRequest(req)
+// used as the ErrorHandler of the reverse proxies. it answers with a 500,
+// as the proxy always has when the upstream is down, and flags the failure
+// for reRecord.
+func upstreamErrorHandler(resp http.ResponseWriter, req *http.Request, err error) {
+	if failed, ok := req.Context().Value(upstreamFailedKey{}).(*bool); ok {
+		*failed = true
+	}
+	log.Printf("http: proxy error: %v", err)
+	resp.WriteHeader(http.StatusInternalServerError)
+}
 
-	handler.ServeHTTP(&proxyWriter, req)
-	writeEpisode(Episode{Request: recordedRequest, Response: proxyWriter.Response}, config)
+func newReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = upstreamErrorHandler
+	return proxy
 }
 
 func recordRequest(req *http.Request) RecordedRequest {
 	body, _ := peekBytes(req)
 	form, _ := peekForm(req)
 	return RecordedRequest{
+		Target: requestTarget(req),
+		Host:   req.Host,
 		URL:    req.URL,
 		Header: req.Header,
 		Method: req.Method,
@@ -153,34 +337,125 @@ func recordRequest(req *http.Request) RecordedRequest {
 	}
 }
 
-func writeEpisode(episode Episode, config *Config) {
-	config.Episodes = append(config.Episodes, episode)
-	config.Save()
-}
-
-func findEpisode(req *http.Request, config *Config) *Episode {
-	for _, episode := range config.Episodes {
+func findEpisodeIndex(req *http.Request, config *Config) int {
+	req = matchableRequest(req, config)
+	for i, episode := range config.Episodes {
 		if sameRequest(&episode.Request, req, *config) {
-			return &episode
+			return i
 		}
 	}
-	return nil
+	return -1
+}
+
+// recorded episodes have their secrets redacted, so live requests have to
+// be redacted the same way to match them
+func matchableRequest(req *http.Request, config *Config) *http.Request {
+	if config.Redact.empty() {
+		return req
+	}
+	redacted := config.Redact.redactRequest(recordRequest(req))
+	matchable := redacted.httpRequest()
+	if spooled := requestSpooledBody(req); spooled != nil {
+		matchable = withSpooledBody(matchable, spooled)
+	}
+	return matchable
 }
 
-func serveEpisode(episode *Episode, resp http.ResponseWriter) {
+func serveEpisode(episode *Episode, resp http.ResponseWriter, req *http.Request, config *Config) {
+	// blobs are streamed from disk
+	var body io.Reader
+	if name := episode.Response.BodyBlob; name != "" {
+		file, err := os.Open(config.blobPath(name))
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("betamax: recorded body is missing: %s", err), 500)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
 	for k, values := range episode.Response.Header {
 		for _, value := range values {
 			resp.Header().Add(k, value)
 		}
 	}
+
+	// bodies recorded compressed are compressed again if the client
+	// accepts it, and served as they are stored otherwise
+	if body == nil {
+		data := episode.Response.Body
+		if encoding := episode.Response.ContentEncoding; encoding != "" && acceptsEncoding(req.Header, encoding) {
+			if encoded, err := encodeBody(data, encoding); err == nil {
+				resp.Header().Set("Content-Encoding", encoding)
+				data = encoded
+			}
+		}
+		body = bytes.NewReader(data)
+	}
+
+	latency := config.latencyFor(req)
+	if !latency.wait(episode, req) {
+		return
+	}
 	resp.WriteHeader(episode.Response.StatusCode)
-	resp.Write(episode.Response.Body)
+	if len(episode.Response.Chunks) > 0 {
+		latency.stream(resp, req, body, episode.Response.Chunks, config.ReplaySpeed)
+	} else {
+		latency.write(resp, req, body)
+	}
 }
 
-func Proxy(target *url.URL, cassetteDir string) http.Handler {
-	config := &Config{CassetteDir: cassetteDir, RecordNewEpisodes: true, RewriteHostHeader: true, TargetHost: target.Host}
+// Flush writes the episodes that a proxy returned by Proxy or ForwardProxy
+// has recorded but not written yet, in every session. Call it before the
+// process exits, since episodes are batched for flush_interval_ms.
+func Flush(proxy http.Handler) error {
+	if flusher, ok := proxy.(interface{ flush() error }); ok {
+		return flusher.flush()
+	}
+	return nil
+}
+
+// Proxy returns a reverse proxy for target, recording into cassettes in
+// cassetteDir. Requests matching one of routes go to its target instead.
+func Proxy(target *url.URL, cassetteDir string, routes ...Route) http.Handler {
+	config := reverseProxyConfig(target, cassetteDir, routes...)
+	return newProxy(newReverseProxy(target), newStore(config))
+}
+
+func reverseProxyConfig(target *url.URL, cassetteDir string, routes ...Route) *Config {
+	config := defaultConfig(cassetteDir)
+	config.RewriteHostHeader = true
+	config.TargetURL = target.String()
+	config.TargetHost = target.Host
+	for _, route := range routes {
+		if err := route.normalize(); err != nil {
+			log.Printf("betamax: ignoring route: %s", err)
+			continue
+		}
+		config.Routes = append(config.Routes, route)
+	}
+	return config
+}
+
+func defaultConfig(cassetteDir string) *Config {
+	return &Config{
+		CassetteDir:   cassetteDir,
+		RecordMode:    RecordNewEpisodes,
+		FlushInterval: 100,
+	}
+}
+
+// wraps the handler sending requests upstream with recording, playback
+// and the config endpoints, with store holding the default session
+func newProxy(upstream http.Handler, store *store) http.Handler {
+	return newSessions(upstream, store)
+}
 
-	cassetteHandler := cassetteHandler(httputil.NewSingleHostReverseProxy(target), config)
-	rewriteHeaderHandler := rewriteHeaderHandler(cassetteHandler, config)
-	return configHandler(rewriteHeaderHandler, config)
+// the handlers of one session
+func sessionHandler(upstream http.Handler, store *store) http.Handler {
+	cassetteHandler := cassetteHandler(routingHandler(upstream), store)
+	faultHandler := faultHandler(cassetteHandler, store)
+	rewriteHeaderHandler := rewriteHeaderHandler(faultHandler, store)
+	routeHandler := routeHandler(rewriteHeaderHandler, store)
+	return configHandler(routeHandler, store)
 }
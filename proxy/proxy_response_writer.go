@@ -1,10 +1,27 @@
 package proxy
 
-import "net/http"
+import (
+	"mime"
+	"net/http"
+	"time"
+)
 
 type ProxyResponseWriter struct {
 	Writer   http.ResponseWriter
 	Response RecordedResponse
+	// if set, a body growing beyond BlobThreshold bytes is written to a
+	// blob file in BlobDir instead of Response.Body
+	BlobThreshold int64
+	BlobDir       string
+
+	blob *blobWriter
+	err  error
+
+	// when the headers were written, and how many body bytes had been
+	// written in total and up to the last flush, to record chunks
+	started time.Time
+	written int
+	flushed int
 }
 
 func (p *ProxyResponseWriter) Header() http.Header {
@@ -12,14 +29,97 @@ func (p *ProxyResponseWriter) Header() http.Header {
 }
 
 func (p *ProxyResponseWriter) Write(bytes []byte) (int, error) {
-	p.Response.Body = append(p.Response.Body, bytes...)
+	if p.started.IsZero() {
+		p.started = time.Now()
+	}
+	p.written += len(bytes)
+
+	if p.blob == nil && p.err == nil && p.BlobThreshold > 0 && int64(len(p.Response.Body)+len(bytes)) > p.BlobThreshold {
+		p.blob, p.err = newBlobWriter(p.BlobDir)
+		if p.err == nil {
+			_, p.err = p.blob.Write(p.Response.Body)
+			p.Response.Body = nil
+		}
+	}
+
+	if p.blob != nil {
+		if _, err := p.blob.Write(bytes); err != nil && p.err == nil {
+			p.err = err
+		}
+	} else {
+		p.Response.Body = append(p.Response.Body, bytes...)
+	}
 	return p.Writer.Write(bytes)
 }
 
+// stores a body written to a blob file under its name, once the whole
+// response has been written
+func (p *ProxyResponseWriter) finish() error {
+	// the end of a streamed body is its last chunk
+	if len(p.Response.Chunks) > 0 {
+		p.addChunk()
+	}
+
+	if p.blob == nil {
+		return p.err
+	}
+	if p.err != nil {
+		p.blob.discard()
+		return p.err
+	}
+	name, err := p.blob.commit()
+	p.Response.BodyBlob = name
+	return err
+}
+
 func (p *ProxyResponseWriter) WriteHeader(statusCode int) {
 	// according to docs, once WriteHeader is called, further modifications to Header have
 	// no effect; hence, we can copy it here.
 	p.Response.Header = p.Writer.Header()
 	p.Response.StatusCode = statusCode
+	p.started = time.Now()
 	p.Writer.WriteHeader(statusCode)
 }
+
+// records what has been written since the last flush as a chunk of an
+// event stream, and passes the flush on. the reverse proxy flushes every
+// response without a Content-Length, so other responses keep no chunks
+// and are replayed at once.
+func (p *ProxyResponseWriter) Flush() {
+	if isEventStream(p.Writer.Header()) {
+		p.addChunk()
+	}
+	if flusher, ok := p.Writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (p *ProxyResponseWriter) addChunk() {
+	if p.written > p.flushed {
+		p.Response.Chunks = append(p.Response.Chunks, Chunk{Size: p.written - p.flushed, Elapsed: time.Since(p.started)})
+		p.flushed = p.written
+	}
+}
+
+// whether header is the header of a stream of server-sent events
+func isEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// a ResponseWriter that throws the response away, for use with a
+// ProxyResponseWriter when the response should only be captured
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (b *discardResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *discardResponseWriter) Write(bytes []byte) (int, error) {
+	return len(bytes), nil
+}
+
+func (b *discardResponseWriter) WriteHeader(statusCode int) {
+}
@@ -1,14 +1,20 @@
 package proxy_test
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/websocket"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	. "github.com/thegreatape/betamax/proxy"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"mime/multipart"
 	"net"
 	"net/http"
@@ -16,6 +22,10 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var _ = Describe("Proxy", func() {
@@ -26,7 +36,7 @@ var _ = Describe("Proxy", func() {
 	var proxyPort string
 	var targetUrl *url.URL
 	var cassetteDir string
-	var requestCount int
+	var requestCount int64
 
 	proxyGetWithHeaders := func(path string, headers map[string]string) (*http.Response, error) {
 		client := new(http.Client)
@@ -103,19 +113,67 @@ var _ = Describe("Proxy", func() {
 		_, proxyPort, _ = net.SplitHostPort(proxyListener.Addr().String())
 
 		targetServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			requestCount++
+			count := atomic.AddInt64(&requestCount, 1)
 			if request.URL.Path == "/request-count" {
-				io.WriteString(writer, fmt.Sprintf("%d requests so far", requestCount))
+				io.WriteString(writer, fmt.Sprintf("%d requests so far", count))
+			} else if request.URL.Path == "/secret" {
+				writer.Header().Set("Content-Type", "application/json")
+				writer.Header().Set("Set-Cookie", "session=s3cr3t-cookie")
+				io.WriteString(writer, fmt.Sprintf(`{"token": "s3cr3t-token", "count": %d}`, count))
+			} else if request.URL.Path == "/compressed" {
+				encoding := request.URL.Query().Get("encoding")
+				writer.Header().Set("Content-Type", "application/json")
+				writer.Header().Set("Content-Encoding", encoding)
+				var compressor io.WriteCloser
+				switch encoding {
+				case "gzip":
+					compressor = gzip.NewWriter(writer)
+				case "deflate":
+					compressor = zlib.NewWriter(writer)
+				case "br":
+					compressor = brotli.NewWriter(writer)
+				}
+				io.WriteString(compressor, fmt.Sprintf(`{"count": %d}`, count))
+				compressor.Close()
 			} else if request.URL.Path == "/echo-host" {
 				io.WriteString(writer, request.Host)
+			} else if request.URL.Path == "/events" {
+				writer.Header().Set("Content-Type", "text/event-stream")
+				if contentType := request.URL.Query().Get("content_type"); contentType != "" {
+					writer.Header().Set("Content-Type", contentType)
+				}
+				for i := 1; i <= 3; i++ {
+					if i > 1 {
+						time.Sleep(100 * time.Millisecond)
+					}
+					io.WriteString(writer, fmt.Sprintf("data: event %d\n\n", i))
+					writer.(http.Flusher).Flush()
+				}
+			} else if request.URL.Path == "/socket" {
+				conn, err := (&websocket.Upgrader{}).Upgrade(writer, request, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				for {
+					kind, message, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					conn.WriteMessage(kind, []byte(fmt.Sprintf("echo %d: %s", count, message)))
+				}
+			} else if request.URL.Path == "/large" {
+				writer.Header().Set("Content-Type", "application/octet-stream")
+				io.CopyN(writer, rand.New(rand.NewSource(count)), 100000)
 			} else {
 				io.WriteString(writer, "hello, world")
 			}
 		}))
 
 		targetUrl, _ = url.Parse(targetServer.URL)
-		cassetteDir = path.Join(os.TempDir(), "cassettes")
-		os.RemoveAll(cassetteDir)
+		// a fresh directory per spec, so batched writes of a previous
+		// spec's proxy can't leak into this one
+		cassetteDir, _ = ioutil.TempDir("", "cassettes")
 		proxy = Proxy(targetUrl, cassetteDir)
 		go http.Serve(proxyListener, proxy)
 	})
@@ -123,6 +181,7 @@ var _ = Describe("Proxy", func() {
 	AfterEach(func() {
 		targetServer.Close()
 		proxyListener.Close()
+		os.RemoveAll(cassetteDir)
 	})
 
 	It("proxies without any configuration", func() {
@@ -166,6 +225,299 @@ var _ = Describe("Proxy", func() {
 
 			Expect(jsonResponse["cassette"]).To(Equal("test-cassette"))
 		})
+
+		configRequest := func(method string, body string) (int, map[string]interface{}) {
+			req, _ := http.NewRequest(method, fmt.Sprintf("http://127.0.0.1:%s/__betamax__/config", proxyPort), strings.NewReader(body))
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			defer resp.Body.Close()
+			Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+
+			var jsonResponse map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&jsonResponse)).To(Succeed())
+			return resp.StatusCode, jsonResponse
+		}
+
+		It("reports the resulting configuration and the loaded episodes", func() {
+			configureProxy(map[string]interface{}{"cassette": "test-cassette", "flush_interval_ms": 0})
+			proxyGet("/")
+
+			status, jsonResponse := configRequest("POST", `{"record_mode": "none"}`)
+			Expect(status).To(Equal(200))
+			Expect(jsonResponse["episodes"]).To(BeNumerically("==", 1))
+			config := jsonResponse["config"].(map[string]interface{})
+			Expect(config["cassette"]).To(Equal("test-cassette"))
+			Expect(config["record_mode"]).To(Equal("none"))
+		})
+
+		It("rejects unknown settings, values of the wrong type and cassettes outside the cassette directory", func() {
+			status, jsonResponse := configRequest("POST", `{"casette": "typo"}`)
+			Expect(status).To(Equal(400))
+			Expect(jsonResponse["error"]).To(ContainSubstring(`unknown field "casette"`))
+
+			status, jsonResponse = configRequest("POST", `{"flush_interval_ms": "soon"}`)
+			Expect(status).To(Equal(400))
+			Expect(jsonResponse["error"]).To(Equal("flush_interval_ms must be a number, not string"))
+
+			status, jsonResponse = configRequest("POST", `{"cassette": "../../etc/passwd"}`)
+			Expect(status).To(Equal(400))
+			Expect(jsonResponse["error"]).To(ContainSubstring("invalid cassette name"))
+
+			status, _ = configRequest("POST", `{"record_mode": "sometimes"`)
+			Expect(status).To(Equal(400))
+
+			status, jsonResponse = configRequest("POST", `{"CassetteDir": "/tmp", "cassette": "elsewhere"}`)
+			Expect(status).To(Equal(400))
+			Expect(jsonResponse["error"]).To(ContainSubstring(`unknown field "CassetteDir"`))
+
+			_, jsonResponse = configRequest("GET", "")
+			Expect(jsonResponse["cassette"]).To(Equal(""))
+			Expect(jsonResponse).ToNot(HaveKey("CassetteDir"))
+			Expect(jsonResponse).ToNot(HaveKey("Episodes"))
+		})
+
+		It("leaves the configuration untouched when an update is rejected", func() {
+			configureProxy(map[string]interface{}{"match_on": []string{"method", "path"}})
+
+			status, _ := configRequest("POST", `{"match_on": ["bogus", "path"]}`)
+			Expect(status).To(Equal(400))
+
+			_, jsonResponse := configRequest("GET", "")
+			Expect(jsonResponse["match_on"]).To(Equal([]interface{}{"method", "path"}))
+		})
+
+		It("resets settings given as null with a PATCH to the ones the proxy started with", func() {
+			configureProxy(map[string]interface{}{"cassette": "test-cassette", "record_mode": "none", "match_on": []string{"method"}, "rewrite_host_header": false})
+
+			status, jsonResponse := configRequest("PATCH", `{"record_mode": null, "match_on": null, "rewrite_host_header": null}`)
+			Expect(status).To(Equal(200))
+			config := jsonResponse["config"].(map[string]interface{})
+			Expect(config["cassette"]).To(Equal("test-cassette"))
+			Expect(config["record_mode"]).To(Equal("new_episodes"))
+			Expect(config["match_on"]).To(BeNil())
+			Expect(config["rewrite_host_header"]).To(BeTrue())
+		})
+
+		It("refuses other methods", func() {
+			status, jsonResponse := configRequest("DELETE", "")
+			Expect(status).To(Equal(405))
+			Expect(jsonResponse["error"]).ToNot(BeEmpty())
+		})
+	})
+
+	Context("manages cassettes over http", func() {
+		cassettesRequest := func(method string, path string, body string) (int, string) {
+			req, _ := http.NewRequest(method, fmt.Sprintf("http://127.0.0.1:%s/__betamax__/cassettes%s", proxyPort, path), strings.NewReader(body))
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			defer resp.Body.Close()
+			data, _ := ioutil.ReadAll(resp.Body)
+			return resp.StatusCode, string(data)
+		}
+
+		getCount := func() string {
+			resp, err := proxyGet("/request-count")
+			Expect(err).To(BeNil())
+			body, _ := ioutil.ReadAll(resp.Body)
+			return string(body)
+		}
+
+		BeforeEach(func() {
+			configureProxy(map[string]interface{}{"cassette": "first", "flush_interval_ms": 0})
+			getCount()
+			configureProxy(map[string]interface{}{"cassette": "second"})
+			getCount()
+			getCount()
+		})
+
+		It("lists, fetches and deletes cassettes", func() {
+			status, body := cassettesRequest("GET", "", "")
+			Expect(status).To(Equal(200))
+			Expect(body).To(MatchJSON(`[{"name": "first", "format": "json"}, {"name": "second", "format": "json"}]`))
+
+			status, body = cassettesRequest("GET", "/first", "")
+			Expect(status).To(Equal(200))
+			var cassette WriteableCassette
+			Expect(json.Unmarshal([]byte(body), &cassette)).To(Succeed())
+			Expect(cassette.Episodes).To(HaveLen(1))
+
+			status, _ = cassettesRequest("DELETE", "/first", "")
+			Expect(status).To(Equal(204))
+			status, _ = cassettesRequest("GET", "/first", "")
+			Expect(status).To(Equal(404))
+			status, _ = cassettesRequest("DELETE", "/first", "")
+			Expect(status).To(Equal(404))
+		})
+
+		It("lists and deletes episodes of the inserted cassette", func() {
+			status, body := cassettesRequest("GET", "/second/episodes", "")
+			Expect(status).To(Equal(200))
+			var episodes []WriteableEpisode
+			Expect(json.Unmarshal([]byte(body), &episodes)).To(Succeed())
+			Expect(episodes).To(HaveLen(1))
+
+			status, body = cassettesRequest("GET", "/second/episodes/0", "")
+			Expect(status).To(Equal(200))
+			Expect(body).To(ContainSubstring("2 requests so far"))
+			status, _ = cassettesRequest("GET", "/second/episodes/1", "")
+			Expect(status).To(Equal(404))
+
+			status, _ = cassettesRequest("DELETE", "/second/episodes/0", "")
+			Expect(status).To(Equal(204))
+			Expect(getCount()).To(Equal("3 requests so far"))
+		})
+
+		It("replaces cassettes with uploaded ones", func() {
+			status, body := cassettesRequest("GET", "/first", "")
+			Expect(status).To(Equal(200))
+
+			Expect(ioutil.WriteFile(path.Join(cassetteDir, "second.har"), []byte("{}"), 0600)).To(Succeed())
+			status, _ = cassettesRequest("PUT", "/second", body)
+			Expect(status).To(Equal(200))
+			Expect(getCount()).To(Equal("1 requests so far"))
+			_, err := os.Stat(path.Join(cassetteDir, "second.json"))
+			Expect(err).To(BeNil())
+			_, err = os.Stat(path.Join(cassetteDir, "second.har"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			status, _ = cassettesRequest("PUT", "/second", `{"format_version": 1`)
+			Expect(status).To(Equal(400))
+		})
+
+		It("refuses cassette names outside the cassette directory", func() {
+			status, _ := cassettesRequest("GET", "/..%2Fsecret", "")
+			Expect(status).To(Equal(400))
+			status, _ = cassettesRequest("PUT", "/.hidden", `{"format_version": 2, "episodes": []}`)
+			Expect(status).To(Equal(400))
+		})
+	})
+
+	Context("with sessions", func() {
+		sessionsRequest := func(method string, path string, body string) (int, string) {
+			req, _ := http.NewRequest(method, fmt.Sprintf("http://127.0.0.1:%s/__betamax__/sessions%s", proxyPort, path), strings.NewReader(body))
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			defer resp.Body.Close()
+			data, _ := ioutil.ReadAll(resp.Body)
+			return resp.StatusCode, string(data)
+		}
+
+		sessionGet := func(session string, path string) (int, string) {
+			headers := map[string]string{}
+			if session != "" {
+				headers["X-Betamax-Session"] = session
+			}
+			resp, err := proxyGetWithHeaders(path, headers)
+			Expect(err).To(BeNil())
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			return resp.StatusCode, string(body)
+		}
+
+		It("keeps the cassettes and record modes of sessions apart", func() {
+			configureProxy(map[string]interface{}{"cassette": "default-cassette"})
+			status, _ := sessionsRequest("POST", "", `{"name": "worker-1", "config": {"cassette": "worker-cassette"}}`)
+			Expect(status).To(Equal(201))
+
+			_, body := sessionGet("worker-1", "/request-count")
+			Expect(body).To(Equal("1 requests so far"))
+			_, body = sessionGet("", "/request-count")
+			Expect(body).To(Equal("2 requests so far"))
+
+			req, _ := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%s/__betamax__/config", proxyPort), strings.NewReader(`{"record_mode": "none"}`))
+			req.Header.Set("X-Betamax-Session", "worker-1")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(200))
+
+			_, body = sessionGet("worker-1", "/request-count")
+			Expect(body).To(Equal("1 requests so far"))
+			status, _ = sessionGet("worker-1", "/other")
+			Expect(status).To(Equal(403))
+			_, body = sessionGet("", "/other")
+			Expect(body).To(Equal("hello, world"))
+
+			_, body = sessionsRequest("GET", "", "")
+			Expect(body).To(MatchJSON(`[{"name": "worker-1", "cassette": "worker-cassette"}]`))
+
+			status, _ = sessionsRequest("DELETE", "/worker-1", "")
+			Expect(status).To(Equal(204))
+			loaded := Config{Cassette: "worker-cassette", CassetteDir: cassetteDir}
+			Expect(loaded.Load()).To(Succeed())
+			Expect(loaded.Episodes).To(HaveLen(1))
+			Expect(loaded.Episodes[0].Request.Header.Get("X-Betamax-Session")).To(BeEmpty())
+		})
+
+		It("creates and ends sessions through the config endpoint", func() {
+			configRequest := func(method string, body string) (int, string) {
+				req, _ := http.NewRequest(method, fmt.Sprintf("http://127.0.0.1:%s/__betamax__/config", proxyPort), strings.NewReader(body))
+				req.Header.Set("X-Betamax-Session", "worker-5")
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).To(BeNil())
+				defer resp.Body.Close()
+				data, _ := ioutil.ReadAll(resp.Body)
+				return resp.StatusCode, string(data)
+			}
+
+			status, body := configRequest("POST", `{"cassette": "config-cassette", "flush_interval_ms": 60000}`)
+			Expect(status).To(Equal(201))
+			var jsonResponse struct {
+				Config Config `json:"config"`
+			}
+			Expect(json.Unmarshal([]byte(body), &jsonResponse)).To(Succeed())
+			Expect(jsonResponse.Config.Cassette).To(Equal("config-cassette"))
+
+			_, body = sessionGet("worker-5", "/request-count")
+			Expect(body).To(Equal("1 requests so far"))
+			status, _ = configRequest("POST", `{"record_mode": "none"}`)
+			Expect(status).To(Equal(200))
+
+			status, _ = configRequest("DELETE", "")
+			Expect(status).To(Equal(204))
+			loaded := Config{Cassette: "config-cassette", CassetteDir: cassetteDir}
+			Expect(loaded.Load()).To(Succeed())
+			Expect(loaded.Episodes).To(HaveLen(1))
+
+			status, _ = configRequest("DELETE", "")
+			Expect(status).To(Equal(404))
+			status, _ = sessionGet("worker-5", "/request-count")
+			Expect(status).To(Equal(404))
+		})
+
+		It("gives sessions a port of their own", func() {
+			status, body := sessionsRequest("POST", "", `{"name": "worker-2", "port": 0, "config": {"cassette": "port-cassette"}}`)
+			Expect(status).To(Equal(201))
+			var info SessionInfo
+			Expect(json.Unmarshal([]byte(body), &info)).To(Succeed())
+			Expect(info.Port).ToNot(BeZero())
+
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/request-count", info.Port))
+			Expect(err).To(BeNil())
+			data, _ := ioutil.ReadAll(resp.Body)
+			Expect(string(data)).To(Equal("1 requests so far"))
+
+			sessionsRequest("DELETE", "/worker-2", "")
+			_, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/request-count", info.Port))
+			Expect(err).ToNot(BeNil())
+
+			loaded := Config{Cassette: "port-cassette", CassetteDir: cassetteDir}
+			Expect(loaded.Load()).To(Succeed())
+			Expect(loaded.Episodes).To(HaveLen(1))
+		})
+
+		It("refuses unknown and duplicate sessions", func() {
+			status, _ := sessionGet("nobody", "/")
+			Expect(status).To(Equal(404))
+
+			status, _ = sessionsRequest("POST", "", `{"name": "worker-3"}`)
+			Expect(status).To(Equal(201))
+			status, _ = sessionsRequest("POST", "", `{"name": "worker-3"}`)
+			Expect(status).To(Equal(409))
+			status, _ = sessionsRequest("POST", "", `{"name": "../worker"}`)
+			Expect(status).To(Equal(400))
+			status, _ = sessionsRequest("DELETE", "/worker-4", "")
+			Expect(status).To(Equal(404))
+		})
 	})
 
 	Context("records and plays back proxied responses", func() {
@@ -260,6 +612,54 @@ var _ = Describe("Proxy", func() {
 			Expect(string(body)).To(Equal("1 requests so far"))
 		})
 
+		It("matches query strings regardless of parameter order", func() {
+			configureProxy(map[string]interface{}{"cassette": "test-cassette"})
+
+			resp, _ := proxyGet("/request-count?a=1&b=2")
+			body, _ := ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("1 requests so far"))
+
+			resp, _ = proxyGet("/request-count?b=2&a=1")
+			body, _ = ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("1 requests so far"))
+
+			resp, _ = proxyGet("/request-count?b=2&a=1&a=3")
+			body, _ = ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("2 requests so far"))
+		})
+
+		It("ignores configured query parameters", func() {
+			configureProxy(map[string]interface{}{"cassette": "test-cassette", "ignore_query_params": []string{"_"}})
+
+			resp, _ := proxyGet("/request-count?foo=bar&_=1234")
+			body, _ := ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("1 requests so far"))
+
+			resp, _ = proxyGet("/request-count?_=5678&foo=bar")
+			body, _ = ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("1 requests so far"))
+
+			resp, _ = proxyGet("/request-count?foo=baz&_=5678")
+			body, _ = ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("2 requests so far"))
+		})
+
+		It("only compares the named query parameters when configured to", func() {
+			configureProxy(map[string]interface{}{"cassette": "test-cassette", "match_query_params": []string{"page"}})
+
+			resp, _ := proxyGet("/request-count?page=1&session=abc")
+			body, _ := ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("1 requests so far"))
+
+			resp, _ = proxyGet("/request-count?session=def&page=1&tracking=x")
+			body, _ = ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("1 requests so far"))
+
+			resp, _ = proxyGet("/request-count?page=2&session=abc")
+			body, _ = ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("2 requests so far"))
+		})
+
 		It("records nothing without a current cassette", func() {
 			resp, err := proxyGet("/")
 			body, _ := ioutil.ReadAll(resp.Body)
@@ -279,9 +679,11 @@ var _ = Describe("Proxy", func() {
 
 			resp, _ := proxyGet("/request-count")
 			Expect(resp.StatusCode).To(Equal(403))
+			Expect(resp.Header.Get("X-Betamax-Denied")).To(Equal("true"))
 
 			body, _ := ioutil.ReadAll(resp.Body)
-			Expect(string(body)).To(Equal(""))
+			Expect(string(body)).To(ContainSubstring("GET /request-count"))
+			Expect(atomic.LoadInt64(&requestCount)).To(Equal(int64(0)))
 		})
 
 		It("does not record new episodes when the option is unset", func() {
@@ -296,23 +698,1019 @@ var _ = Describe("Proxy", func() {
 			Expect(string(body)).To(Equal("2 requests so far"))
 		})
 
+		It("maps the legacy flags onto record modes", func() {
+			getRecordMode := func() interface{} {
+				resp, _ := proxyGet("/__betamax__/config")
+				var jsonResponse map[string]interface{}
+				json.NewDecoder(resp.Body).Decode(&jsonResponse)
+				return jsonResponse["record_mode"]
+			}
+
+			Expect(getRecordMode()).To(Equal("new_episodes"))
+
+			configureProxy(map[string]interface{}{"deny_unrecorded_requests": true})
+			Expect(getRecordMode()).To(Equal("none"))
+
+			configureProxy(map[string]interface{}{"deny_unrecorded_requests": false})
+			Expect(getRecordMode()).To(Equal("new_episodes"))
+
+			configureProxy(map[string]interface{}{"record_new_episodes": false})
+			Expect(getRecordMode()).To(Equal("all"))
+		})
+
+		Context("with record mode", func() {
+			It("once records a new cassette, then only replays it", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "record_mode": "once"})
+
+				resp, _ := proxyGet("/request-count")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+
+				resp, _ = proxyGet("/")
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("hello, world"))
+
+				configureProxy(map[string]interface{}{"cassette": "test-cassette"})
+
+				resp, _ = proxyGet("/request-count")
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+
+				resp, _ = proxyGet("/echo-host")
+				Expect(resp.StatusCode).To(Equal(403))
+				Expect(atomic.LoadInt64(&requestCount)).To(Equal(int64(2)))
+			})
+
+			It("new_episodes replays recorded requests and records new ones", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "record_mode": "new_episodes"})
+
+				resp, _ := proxyGet("/request-count")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+
+				resp, _ = proxyGet("/request-count?again")
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("2 requests so far"))
+
+				resp, _ = proxyGet("/request-count")
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+			})
+
+			It("none replays recorded requests and refuses new ones", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette"})
+				proxyGet("/request-count")
+
+				configureProxy(map[string]interface{}{"record_mode": "none"})
+
+				resp, _ := proxyGet("/request-count")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+
+				resp, _ = proxyGet("/request-count?again")
+				Expect(resp.StatusCode).To(Equal(403))
+				Expect(atomic.LoadInt64(&requestCount)).To(Equal(int64(1)))
+			})
+
+			It("all re-records every request and overwrites the old episode", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette"})
+				proxyGet("/request-count")
+
+				configureProxy(map[string]interface{}{"record_mode": "all"})
+
+				resp, _ := proxyGet("/request-count")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("2 requests so far"))
+
+				configureProxy(map[string]interface{}{"record_mode": "none"})
+
+				resp, _ = proxyGet("/request-count")
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("2 requests so far"))
+			})
+		})
+
+		Context("with configured matchers", func() {
+			proxyPostJSON := func(body string) string {
+				resp, _ := http.Post(fmt.Sprintf("http://127.0.0.1:%s/request-count", proxyPort), "application/json", bytes.NewBufferString(body))
+				responseBody, _ := ioutil.ReadAll(resp.Body)
+				return string(responseBody)
+			}
+
+			It("only compares what the named matchers look at", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "match_on": []string{"method", "path", "json_body"}})
+
+				Expect(proxyPostJSON(`{"a": 1, "b": [1, 2]}`)).To(Equal("1 requests so far"))
+				Expect(proxyPostJSON(`{"b":[1,2],"a":1}`)).To(Equal("1 requests so far"))
+				Expect(proxyPostJSON(`{"a": 2, "b": [1, 2]}`)).To(Equal("2 requests so far"))
+
+				resp, _ := proxyGet("/request-count?ignored=true")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("3 requests so far"))
+
+				resp, _ = proxyGet("/request-count?ignored=yes")
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("3 requests so far"))
+			})
+
+			It("ignores volatile JSON fields", func() {
+				configureProxy(map[string]interface{}{
+					"cassette":          "test-cassette",
+					"match_on":          []string{"method", "path", "json_body"},
+					"ignore_json_paths": []string{"$.timestamp", "$.items[*].nonce", "$..trace_id"},
+				})
+
+				Expect(proxyPostJSON(`{"timestamp": 1, "items": [{"id": 1, "nonce": "a"}], "meta": {"trace_id": "x"}}`)).To(Equal("1 requests so far"))
+				Expect(proxyPostJSON(`{"timestamp": 2, "items": [{"id": 1, "nonce": "b"}], "meta": {"trace_id": "y"}}`)).To(Equal("1 requests so far"))
+				Expect(proxyPostJSON(`{"timestamp": 2, "items": [{"id": 2, "nonce": "b"}], "meta": {"trace_id": "y"}}`)).To(Equal("2 requests so far"))
+			})
+
+			It("compares bodies without a JSON content type byte for byte", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "match_on": []string{"method", "path", "json_body"}})
+
+				post := func(body string) string {
+					resp, _ := http.Post(fmt.Sprintf("http://127.0.0.1:%s/request-count", proxyPort), "text/plain", bytes.NewBufferString(body))
+					responseBody, _ := ioutil.ReadAll(resp.Body)
+					return string(responseBody)
+				}
+				Expect(post(`{"a": 1}`)).To(Equal("1 requests so far"))
+				Expect(post(`{"a":1}`)).To(Equal("2 requests so far"))
+			})
+
+			It("rejects invalid JSON paths", func() {
+				resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%s/__betamax__/config", proxyPort), "text/json",
+					bytes.NewBufferString(`{"ignore_json_paths": ["$.items[oops"]}`))
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(400))
+			})
+
+			It("uses matchers registered by the embedding program", func() {
+				RegisterMatcher("user_agent", MatcherFunc(func(recorded *RecordedRequest, req *http.Request, config *Config) bool {
+					return recorded.Header.Get("User-Agent") == req.Header.Get("User-Agent")
+				}))
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "match_on": []string{"path", "user_agent"}})
+
+				resp, _ := proxyGetWithHeaders("/request-count", map[string]string{"User-Agent": "one"})
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+
+				resp, _ = proxyGetWithHeaders("/request-count", map[string]string{"User-Agent": "two"})
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("2 requests so far"))
+
+				resp, _ = proxyGetWithHeaders("/request-count", map[string]string{"User-Agent": "one"})
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+			})
+
+			It("rejects unknown matchers", func() {
+				resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%s/__betamax__/config", proxyPort), "text/json",
+					bytes.NewBufferString(`{"match_on": ["method", "no_such_matcher"]}`))
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(400))
+			})
+		})
+
+		Context("with redactions", func() {
+			var cassetteData func() string
+
+			BeforeEach(func() {
+				configureProxy(map[string]interface{}{
+					"cassette":      "test-cassette",
+					"match_headers": []string{"Authorization"},
+					"redact": map[string]interface{}{
+						"headers":       []string{"authorization", "Set-Cookie"},
+						"query_params":  []string{"api_key"},
+						"form_fields":   []string{"password"},
+						"json_paths":    []string{"$.token"},
+						"body_patterns": []string{`user=(\w+)`},
+					},
+				})
+
+				cassetteData = func() string {
+					var data []byte
+					Eventually(func() (err error) {
+						data, err = ioutil.ReadFile(path.Join(cassetteDir, "test-cassette.json"))
+						return
+					}).Should(Succeed())
+					return string(data)
+				}
+			})
+
+			It("keeps secrets out of the cassette but still passes them through", func() {
+				resp, _ := proxyGetWithHeaders("/secret?api_key=s3cr3t-key&page=1", map[string]string{"Authorization": "Bearer s3cr3t-auth"})
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(ContainSubstring("s3cr3t-token"))
+				Expect(resp.Header.Get("Set-Cookie")).To(Equal("session=s3cr3t-cookie"))
+
+				proxyPost("/request-count", url.Values{"password": {"s3cr3t-password"}})
+				http.Post(fmt.Sprintf("http://127.0.0.1:%s/request-count", proxyPort), "text/plain", bytes.NewBufferString("user=s3cr3t-user"))
+				proxyPostMultipart("/request-count", map[string][]string{"password": {"s3cr3t-multipart"}, "kind": {"multipart"}})
+
+				Eventually(cassetteData).Should(ContainSubstring("multipart/form-data"))
+				data := cassetteData()
+				Expect(data).ToNot(ContainSubstring("s3cr3t"))
+				Expect(data).To(ContainSubstring("[REDACTED]"))
+				Expect(data).To(ContainSubstring("page=1"))
+
+				configureProxy(map[string]interface{}{"record_mode": "none"})
+				resp, err := proxyGetWithHeaders("/secret?api_key=s3cr3t-key&page=1", map[string]string{"Authorization": "Bearer s3cr3t-auth"})
+				Expect(err).To(BeNil())
+				body, err = ioutil.ReadAll(resp.Body)
+				Expect(err).To(BeNil())
+				Expect(string(body)).To(Equal(`{"count":1,"token":"[REDACTED]"}`))
+			})
+
+			It("replays redacted episodes for requests with any secret", func() {
+				resp, _ := proxyGetWithHeaders("/secret?api_key=one", map[string]string{"Authorization": "Bearer one"})
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(ContainSubstring(`"count": 1`))
+
+				resp, _ = proxyGetWithHeaders("/secret?api_key=two", map[string]string{"Authorization": "Bearer two"})
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(ContainSubstring(`"count":1`))
+				Expect(string(body)).To(ContainSubstring(`"token":"[REDACTED]"`))
+
+				proxyPost("/request-count", url.Values{"password": {"one"}})
+				resp, _ = proxyPost("/request-count", url.Values{"password": {"two"}})
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("2 requests so far"))
+			})
+		})
+
+		Context("with multiple targets", func() {
+			var otherServer *httptest.Server
+			var otherUrl *url.URL
+
+			addTarget := func(route map[string]interface{}) *http.Response {
+				jsonBytes, _ := json.Marshal(route)
+				resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%s/__betamax__/targets", proxyPort), "text/json", bytes.NewBuffer(jsonBytes))
+				Expect(err).To(BeNil())
+				return resp
+			}
+
+			BeforeEach(func() {
+				otherServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+					count := atomic.AddInt64(&requestCount, 1)
+					io.WriteString(writer, fmt.Sprintf("other %s %s %d", request.Host, request.URL.Path, count))
+				}))
+				otherUrl, _ = url.Parse(otherServer.URL)
+			})
+
+			AfterEach(func() {
+				otherServer.Close()
+			})
+
+			It("routes requests by path prefix and rewrites the host per route", func() {
+				resp := addTarget(map[string]interface{}{"name": "other", "path_prefix": "/other", "strip_prefix": true, "target": otherServer.URL})
+				Expect(resp.StatusCode).To(Equal(200))
+
+				resp, _ = proxyGet("/other/thing")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal(fmt.Sprintf("other %s /thing 1", otherUrl.Host)))
+
+				resp, _ = proxyGet("/request-count")
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("2 requests so far"))
+			})
+
+			It("replays requests to routes stripping their prefix", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "flush_interval_ms": 0})
+				addTarget(map[string]interface{}{"name": "other", "path_prefix": "/other", "strip_prefix": true, "target": otherServer.URL})
+
+				for i := 0; i < 2; i++ {
+					resp, _ := proxyGet("/other/thing")
+					body, _ := ioutil.ReadAll(resp.Body)
+					Expect(string(body)).To(Equal(fmt.Sprintf("other %s /thing 1", otherUrl.Host)))
+				}
+
+				cassetteData, _ := ioutil.ReadFile(path.Join(cassetteDir, "test-cassette.json"))
+				var cassette WriteableCassette
+				json.Unmarshal(cassetteData, &cassette)
+				Expect(cassette.Episodes).To(HaveLen(1))
+				Expect(cassette.Episodes[0].Request.URL.Path).To(Equal("/other/thing"))
+			})
+
+			It("matches path prefixes on whole segments", func() {
+				addTarget(map[string]interface{}{"name": "other", "path_prefix": "/request", "target": otherServer.URL})
+
+				resp, _ := proxyGet("/request-count")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+
+				resp, _ = proxyGet("/request/count")
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal(fmt.Sprintf("other %s /request/count 2", otherUrl.Host)))
+
+				resp, _ = proxyGet("/request")
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal(fmt.Sprintf("other %s /request 3", otherUrl.Host)))
+			})
+
+			It("routes requests by host header", func() {
+				addTarget(map[string]interface{}{"host": "api.example.com", "target": otherServer.URL})
+
+				client := new(http.Client)
+				req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%s/thing", proxyPort), nil)
+				req.Host = "api.example.com"
+				resp, err := client.Do(req)
+				Expect(err).To(BeNil())
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal(fmt.Sprintf("other %s /thing 1", otherUrl.Host)))
+			})
+
+			It("records the target of each episode and matches on it", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "flush_interval_ms": 0})
+				addTarget(map[string]interface{}{"name": "other", "path_prefix": "/request-count", "target": otherServer.URL})
+
+				resp, _ := proxyGet("/request-count")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(HavePrefix("other"))
+
+				jsonBytes, _ := json.Marshal(map[string]interface{}{})
+				req, _ := http.NewRequest("DELETE", fmt.Sprintf("http://127.0.0.1:%s/__betamax__/targets?name=other", proxyPort), bytes.NewBuffer(jsonBytes))
+				resp, _ = http.DefaultClient.Do(req)
+				Expect(resp.StatusCode).To(Equal(200))
+
+				resp, _ = proxyGet("/request-count")
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("2 requests so far"))
+
+				cassetteData, _ := ioutil.ReadFile(path.Join(cassetteDir, "test-cassette.json"))
+				var cassette WriteableCassette
+				json.Unmarshal(cassetteData, &cassette)
+				Expect(cassette.Episodes).To(HaveLen(2))
+				Expect(cassette.Episodes[0].Request.Target).To(Equal("other"))
+			})
+
+			It("rejects routes without a target", func() {
+				resp := addTarget(map[string]interface{}{"path_prefix": "/nowhere"})
+				Expect(resp.StatusCode).To(Equal(400))
+			})
+
+			It("rejects routes with unknown fields", func() {
+				resp := addTarget(map[string]interface{}{"path_prefix": "/other", "target": otherServer.URL, "strip": true})
+				Expect(resp.StatusCode).To(Equal(400))
+				Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+
+				var jsonResponse map[string]string
+				Expect(json.NewDecoder(resp.Body).Decode(&jsonResponse)).To(Succeed())
+				Expect(jsonResponse["error"]).To(ContainSubstring(`unknown field "strip"`))
+			})
+
+			It("lists the allowed methods on other requests", func() {
+				req, _ := http.NewRequest("PUT", fmt.Sprintf("http://127.0.0.1:%s/__betamax__/targets", proxyPort), nil)
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(405))
+				Expect(resp.Header.Get("Allow")).To(Equal("GET, POST, DELETE"))
+			})
+
+			It("accepts routes through the config endpoint", func() {
+				configureProxy(map[string]interface{}{"routes": []map[string]interface{}{{"path_prefix": "/other", "target": otherServer.URL}}})
+
+				resp, _ := proxyGet("/other")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(HavePrefix("other"))
+			})
+		})
+
+		Context("with compressed responses", func() {
+			getCompressed := func(encoding string, acceptEncoding string) (*http.Response, string) {
+				resp, err := proxyGetWithHeaders("/compressed?encoding="+encoding, map[string]string{"Accept-Encoding": acceptEncoding})
+				Expect(err).To(BeNil())
+				defer resp.Body.Close()
+
+				var reader io.Reader = resp.Body
+				switch resp.Header.Get("Content-Encoding") {
+				case "gzip":
+					reader, _ = gzip.NewReader(resp.Body)
+				case "deflate":
+					reader, _ = zlib.NewReader(resp.Body)
+				case "br":
+					reader = brotli.NewReader(resp.Body)
+				}
+				body, err := ioutil.ReadAll(reader)
+				Expect(err).To(BeNil())
+				return resp, string(body)
+			}
+
+			for _, encoding := range []string{"gzip", "deflate", "br"} {
+				encoding := encoding
+
+				It(fmt.Sprintf("stores %s encoded bodies readably and encodes them again on replay", encoding), func() {
+					configureProxy(map[string]interface{}{"cassette": "test-cassette", "flush_interval_ms": 0})
+
+					resp, body := getCompressed(encoding, encoding)
+					Expect(resp.Header.Get("Content-Encoding")).To(Equal(encoding))
+					Expect(body).To(Equal(`{"count": 1}`))
+
+					cassetteData, _ := ioutil.ReadFile(path.Join(cassetteDir, "test-cassette.json"))
+					Expect(string(cassetteData)).To(ContainSubstring(`"Body": "{\"count\": 1}"`))
+					Expect(string(cassetteData)).To(ContainSubstring(fmt.Sprintf(`"ContentEncoding": "%s"`, encoding)))
+
+					resp, body = getCompressed(encoding, "gzip, deflate, br")
+					Expect(resp.Header.Get("Content-Encoding")).To(Equal(encoding))
+					Expect(body).To(Equal(`{"count": 1}`))
+
+					resp, body = getCompressed(encoding, "identity")
+					Expect(resp.Header.Get("Content-Encoding")).To(Equal(""))
+					Expect(body).To(Equal(`{"count": 1}`))
+				})
+			}
+
+			It("respects q=0 in Accept-Encoding", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette"})
+				getCompressed("gzip", "gzip")
+
+				resp, body := getCompressed("gzip", "gzip;q=0, br")
+				Expect(resp.Header.Get("Content-Encoding")).To(Equal(""))
+				Expect(body).To(Equal(`{"count": 1}`))
+			})
+		})
+
+		Context("with ordered playback", func() {
+			getCount := func() string {
+				resp, _ := proxyGet("/request-count")
+				if resp.StatusCode != 200 {
+					return resp.Status
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				return string(body)
+			}
+
+			BeforeEach(func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "ordered_playback": true})
+
+				Expect(getCount()).To(Equal("1 requests so far"))
+				Expect(getCount()).To(Equal("2 requests so far"))
+				Expect(getCount()).To(Equal("3 requests so far"))
+			})
+
+			It("replays repeated requests in recording order and rewinds on demand", func() {
+				configureProxy(map[string]interface{}{"record_mode": "none", "rewind": true})
+
+				Expect(getCount()).To(Equal("1 requests so far"))
+				Expect(getCount()).To(Equal("2 requests so far"))
+
+				configureProxy(map[string]interface{}{"rewind": true})
+
+				Expect(getCount()).To(Equal("1 requests so far"))
+			})
+
+			It("repeats the last episode by default once all have been played", func() {
+				configureProxy(map[string]interface{}{"record_mode": "none"})
+
+				Expect(getCount()).To(Equal("3 requests so far"))
+				Expect(getCount()).To(Equal("3 requests so far"))
+			})
+
+			It("can cycle through the episodes", func() {
+				configureProxy(map[string]interface{}{"record_mode": "none", "playback_exhausted": "cycle", "rewind": true})
+
+				Expect(getCount()).To(Equal("1 requests so far"))
+				Expect(getCount()).To(Equal("2 requests so far"))
+				Expect(getCount()).To(Equal("3 requests so far"))
+				Expect(getCount()).To(Equal("1 requests so far"))
+				Expect(getCount()).To(Equal("2 requests so far"))
+			})
+
+			It("can refuse requests once all episodes have been played", func() {
+				configureProxy(map[string]interface{}{"record_mode": "none", "playback_exhausted": "fail"})
+
+				Expect(getCount()).To(Equal("403 Forbidden"))
+			})
+
+			It("re-records the sequence in order in record mode all", func() {
+				configureProxy(map[string]interface{}{"record_mode": "all", "rewind": true})
+
+				Expect(getCount()).To(Equal("4 requests so far"))
+				Expect(getCount()).To(Equal("5 requests so far"))
+				Expect(getCount()).To(Equal("6 requests so far"))
+				Expect(getCount()).To(Equal("7 requests so far"))
+
+				configureProxy(map[string]interface{}{"record_mode": "none", "rewind": true})
+
+				Expect(getCount()).To(Equal("4 requests so far"))
+				Expect(getCount()).To(Equal("5 requests so far"))
+				Expect(getCount()).To(Equal("6 requests so far"))
+				Expect(getCount()).To(Equal("7 requests so far"))
+			})
+		})
+
+		Context("with a re-record interval", func() {
+			getCount := func() string {
+				resp, err := proxyGet("/request-count")
+				Expect(err).To(BeNil())
+				body, _ := ioutil.ReadAll(resp.Body)
+				return string(body)
+			}
+
+			BeforeEach(func() {
+				stale := Config{
+					Cassette:    "test-cassette",
+					CassetteDir: cassetteDir,
+					Episodes: []Episode{{
+						Request:    RecordedRequest{Method: "GET", URL: &url.URL{Path: "/request-count"}, Header: http.Header{}},
+						Response:   RecordedResponse{StatusCode: 200, Header: http.Header{}, Body: []byte("stale")},
+						RecordedAt: time.Now().Add(-2 * time.Hour),
+					}},
+				}
+				Expect(stale.Save()).To(Succeed())
+			})
+
+			It("replays episodes recorded within the interval", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "re_record_interval": 3 * 3600})
+
+				Expect(getCount()).To(Equal("stale"))
+				Expect(atomic.LoadInt64(&requestCount)).To(BeNumerically("==", 0))
+			})
+
+			It("records expired episodes again", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "re_record_interval": 3600, "flush_interval_ms": 0})
+
+				Expect(getCount()).To(Equal("1 requests so far"))
+				Expect(getCount()).To(Equal("1 requests so far"))
+
+				loaded := Config{Cassette: "test-cassette", CassetteDir: cassetteDir}
+				Expect(loaded.Load()).To(Succeed())
+				Expect(loaded.Episodes).To(HaveLen(1))
+				Expect(string(loaded.Episodes[0].Response.Body)).To(Equal("1 requests so far"))
+			})
+
+			It("replaces the expired episode that was played", func() {
+				loaded := Config{Cassette: "test-cassette", CassetteDir: cassetteDir}
+				Expect(loaded.Load()).To(Succeed())
+				fresh := loaded.Episodes[0]
+				fresh.Response.Body = []byte("fresh")
+				fresh.RecordedAt = time.Now()
+				loaded.Episodes = append([]Episode{fresh}, loaded.Episodes...)
+				Expect(loaded.Save()).To(Succeed())
+
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "re_record_interval": 3600, "ordered_playback": true, "flush_interval_ms": 0})
+
+				Expect(getCount()).To(Equal("fresh"))
+				Expect(getCount()).To(Equal("1 requests so far"))
+
+				Expect(loaded.Load()).To(Succeed())
+				Expect(loaded.Episodes).To(HaveLen(2))
+				Expect(string(loaded.Episodes[0].Response.Body)).To(Equal("fresh"))
+				Expect(string(loaded.Episodes[1].Response.Body)).To(Equal("1 requests so far"))
+			})
+
+			It("replays expired episodes while the upstream is down", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "re_record_interval": 3600})
+				targetServer.Close()
+
+				Expect(getCount()).To(Equal("stale"))
+			})
+
+			It("never re-records in record mode none", func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "re_record_interval": 3600, "record_mode": "none"})
+
+				Expect(getCount()).To(Equal("stale"))
+			})
+		})
+
+		Context("with latency simulation", func() {
+			timedGet := func(path string) (string, time.Duration) {
+				start := time.Now()
+				resp, err := proxyGet(path)
+				Expect(err).To(BeNil())
+				body, _ := ioutil.ReadAll(resp.Body)
+				return string(body), time.Since(start)
+			}
+
+			BeforeEach(func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette"})
+				body, _ := timedGet("/request-count")
+				Expect(body).To(Equal("1 requests so far"))
+			})
+
+			It("delays replayed responses", func() {
+				configureProxy(map[string]interface{}{"latency": map[string]interface{}{"delay_ms": 200, "jitter_ms": 50}})
+
+				body, elapsed := timedGet("/request-count")
+				Expect(body).To(Equal("1 requests so far"))
+				Expect(elapsed).To(BeNumerically(">=", 200*time.Millisecond))
+				Expect(elapsed).To(BeNumerically("<", 1*time.Second))
+			})
+
+			It("applies the latency of the first rule matching the URL", func() {
+				configureProxy(map[string]interface{}{
+					"latency":       map[string]interface{}{"delay_ms": 5000},
+					"latency_rules": []map[string]interface{}{{"url_pattern": "/request-count$", "delay_ms": 0}},
+				})
+
+				_, elapsed := timedGet("/request-count")
+				Expect(elapsed).To(BeNumerically("<", 1*time.Second))
+			})
+
+			It("reproduces the recorded round trip time", func() {
+				config := Config{Cassette: "slow-cassette", CassetteDir: cassetteDir, Episodes: []Episode{{
+					Request:  RecordedRequest{Method: "GET", URL: &url.URL{Path: "/slow"}, Header: http.Header{}},
+					Response: RecordedResponse{StatusCode: 200, Header: http.Header{}, Body: []byte("slow")},
+					Duration: 250 * time.Millisecond,
+				}}}
+				Expect(config.Save()).To(Succeed())
+				configureProxy(map[string]interface{}{"cassette": "slow-cassette", "latency": map[string]interface{}{"recorded": true}})
+
+				body, elapsed := timedGet("/slow")
+				Expect(body).To(Equal("slow"))
+				Expect(elapsed).To(BeNumerically(">=", 250*time.Millisecond))
+			})
+
+			It("throttles the bandwidth of response bodies", func() {
+				configureProxy(map[string]interface{}{"latency": map[string]interface{}{"bytes_per_second": 40}})
+
+				body, elapsed := timedGet("/request-count")
+				Expect(body).To(Equal("1 requests so far"))
+				Expect(elapsed).To(BeNumerically(">=", 300*time.Millisecond))
+			})
+
+			It("rejects invalid latency settings", func() {
+				jsonBytes, _ := json.Marshal(map[string]interface{}{"latency_rules": []map[string]interface{}{{"url_pattern": "(", "delay_ms": 10}}})
+				resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%s/__betamax__/config", proxyPort), "text/json", bytes.NewBuffer(jsonBytes))
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(400))
+			})
+		})
+
+		Context("with fault injection", func() {
+			injectFaults := func(rules ...map[string]interface{}) {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "faults": rules})
+			}
+
+			It("answers with the configured status code a limited number of times", func() {
+				injectFaults(map[string]interface{}{"path": "^/request-count", "fault": "status", "status_code": 503, "count": 2})
+
+				for i := 0; i < 2; i++ {
+					resp, err := proxyGet("/request-count")
+					Expect(err).To(BeNil())
+					Expect(resp.StatusCode).To(Equal(503))
+					Expect(resp.Header.Get("X-Betamax-Fault")).To(Equal("status"))
+				}
+
+				resp, _ := proxyGet("/request-count")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+			})
+
+			It("only fails requests with the given method", func() {
+				injectFaults(map[string]interface{}{"method": "POST", "fault": "status"})
+
+				resp, _ := proxyGet("/")
+				Expect(resp.StatusCode).To(Equal(200))
+
+				resp, _ = proxyPost("/", url.Values{"a": {"b"}})
+				Expect(resp.StatusCode).To(Equal(500))
+			})
+
+			It("drops the connection in the middle of the body", func() {
+				injectFaults(map[string]interface{}{"fault": "drop_body"})
+
+				resp, err := proxyGet("/")
+				Expect(err).To(BeNil())
+				_, err = ioutil.ReadAll(resp.Body)
+				Expect(err).To(Equal(io.ErrUnexpectedEOF))
+			})
+
+			It("resets the connection", func() {
+				injectFaults(map[string]interface{}{"fault": "reset"})
+
+				_, err := proxyGet("/")
+				Expect(err).ToNot(BeNil())
+			})
+
+			It("hangs until the client gives up", func() {
+				injectFaults(map[string]interface{}{"fault": "hang"})
+
+				client := &http.Client{Timeout: 200 * time.Millisecond}
+				_, err := client.Get(fmt.Sprintf("http://127.0.0.1:%s/", proxyPort))
+				Expect(err).ToNot(BeNil())
+			})
+
+			It("returns malformed bodies", func() {
+				injectFaults(map[string]interface{}{"fault": "malformed_body"})
+
+				resp, err := proxyGet("/")
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(200))
+				var doc interface{}
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(json.Unmarshal(body, &doc)).ToNot(Succeed())
+			})
+
+			It("only fails requests with the configured probability", func() {
+				injectFaults(map[string]interface{}{"fault": "status", "probability": 0.000001})
+
+				resp, _ := proxyGet("/")
+				Expect(resp.StatusCode).To(Equal(200))
+				Expect(atomic.LoadInt64(&requestCount)).To(BeNumerically("==", 1))
+			})
+
+			It("never fails requests with a probability of 0", func() {
+				injectFaults(map[string]interface{}{"fault": "status", "probability": 0})
+
+				for i := 0; i < 3; i++ {
+					resp, _ := proxyGet("/")
+					Expect(resp.StatusCode).To(Equal(200))
+				}
+				Expect(atomic.LoadInt64(&requestCount)).To(BeNumerically("==", 1))
+			})
+		})
+
+		Context("with large bodies", func() {
+			BeforeEach(func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "blob_threshold_bytes": 1024, "flush_interval_ms": 0})
+			})
+
+			blobs := func() []os.FileInfo {
+				files, _ := ioutil.ReadDir(path.Join(cassetteDir, "test-cassette.blobs"))
+				return files
+			}
+
+			It("streams response bodies to blob files and back on replay", func() {
+				resp, err := proxyGet("/large")
+				Expect(err).To(BeNil())
+				recorded, _ := ioutil.ReadAll(resp.Body)
+				Expect(recorded).To(HaveLen(100000))
+
+				Expect(blobs()).To(HaveLen(1))
+				cassetteData, _ := ioutil.ReadFile(path.Join(cassetteDir, "test-cassette.json"))
+				Expect(len(cassetteData)).To(BeNumerically("<", 10000))
+				Expect(string(cassetteData)).To(ContainSubstring(`"BodyBlob": "` + blobs()[0].Name() + `"`))
+
+				configureProxy(map[string]interface{}{"record_mode": "none"})
+				resp, err = proxyGet("/large")
+				Expect(err).To(BeNil())
+				replayed, _ := ioutil.ReadAll(resp.Body)
+				Expect(replayed).To(Equal(recorded))
+				Expect(atomic.LoadInt64(&requestCount)).To(BeNumerically("==", 1))
+			})
+
+			It("matches large request bodies by their contents", func() {
+				post := func(body []byte) *http.Response {
+					resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%s/request-count", proxyPort), "application/octet-stream", bytes.NewReader(body))
+					Expect(err).To(BeNil())
+					return resp
+				}
+				upload := bytes.Repeat([]byte("betamax "), 10000)
+
+				resp := post(upload)
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+				Expect(blobs()).To(HaveLen(1))
+
+				configureProxy(map[string]interface{}{"record_mode": "none"})
+				resp = post(upload)
+				body, _ = ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+
+				resp = post(append(upload, '!'))
+				Expect(resp.StatusCode).To(Equal(403))
+				Expect(blobs()).To(HaveLen(1))
+			})
+
+			It("keeps bodies in the cassette to redact them", func() {
+				configureProxy(map[string]interface{}{"redact": map[string]interface{}{"body_patterns": []string{`token=(\w+)`}}})
+				upload := strings.Repeat("token=s3cr3t ", 1000)
+
+				resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%s/request-count", proxyPort), "text/plain", strings.NewReader(upload))
+				Expect(err).To(BeNil())
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(Equal("1 requests so far"))
+
+				Expect(blobs()).To(BeEmpty())
+				cassetteData, _ := ioutil.ReadFile(path.Join(cassetteDir, "test-cassette.json"))
+				Expect(string(cassetteData)).To(ContainSubstring("token=[REDACTED]"))
+				Expect(string(cassetteData)).ToNot(ContainSubstring("s3cr3t"))
+			})
+		})
+
+		Context("with streamed responses", func() {
+			// when each event arrived, relative to the request
+			readEvents := func() ([]string, []time.Duration) {
+				start := time.Now()
+				resp, err := proxyGet("/events")
+				Expect(err).To(BeNil())
+				defer resp.Body.Close()
+
+				events := []string{}
+				arrivals := []time.Duration{}
+				reader := bufio.NewReader(resp.Body)
+				for {
+					line, err := reader.ReadString('\n')
+					if strings.HasPrefix(line, "data: ") {
+						events = append(events, strings.TrimSpace(strings.TrimPrefix(line, "data: ")))
+						arrivals = append(arrivals, time.Since(start))
+					}
+					if err != nil {
+						return events, arrivals
+					}
+				}
+			}
+
+			BeforeEach(func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "flush_interval_ms": 0})
+			})
+
+			It("passes events through as they are flushed while recording", func() {
+				events, arrivals := readEvents()
+				Expect(events).To(Equal([]string{"event 1", "event 2", "event 3"}))
+				Expect(arrivals[0]).To(BeNumerically("<", 100*time.Millisecond))
+
+				loaded := Config{Cassette: "test-cassette", CassetteDir: cassetteDir}
+				Expect(loaded.Load()).To(Succeed())
+				chunks := loaded.Episodes[0].Response.Chunks
+				Expect(chunks).To(HaveLen(3))
+				Expect(chunks[0].Size).To(Equal(len("data: event 1\n\n")))
+				Expect(chunks[2].Elapsed).To(BeNumerically(">=", 200*time.Millisecond))
+			})
+
+			It("replays chunks with their recorded timing", func() {
+				readEvents()
+				configureProxy(map[string]interface{}{"record_mode": "none"})
+
+				events, arrivals := readEvents()
+				Expect(events).To(Equal([]string{"event 1", "event 2", "event 3"}))
+				Expect(arrivals[0]).To(BeNumerically("<", 100*time.Millisecond))
+				Expect(arrivals[2]).To(BeNumerically(">=", 190*time.Millisecond))
+				Expect(atomic.LoadInt64(&requestCount)).To(BeNumerically("==", 1))
+			})
+
+			It("replays chunks faster with a replay speed", func() {
+				readEvents()
+				configureProxy(map[string]interface{}{"record_mode": "none", "replay_speed": 10})
+
+				events, arrivals := readEvents()
+				Expect(events).To(HaveLen(3))
+				Expect(arrivals[2]).To(BeNumerically("<", 150*time.Millisecond))
+			})
+
+			It("replays other chunked responses at once", func() {
+				resp, _ := proxyGet("/events?content_type=application/json")
+				ioutil.ReadAll(resp.Body)
+				configureProxy(map[string]interface{}{"record_mode": "none"})
+
+				start := time.Now()
+				resp, _ = proxyGet("/events?content_type=application/json")
+				body, _ := ioutil.ReadAll(resp.Body)
+				Expect(string(body)).To(ContainSubstring("event 3"))
+				Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+
+				loaded := Config{Cassette: "test-cassette", CassetteDir: cassetteDir}
+				Expect(loaded.Load()).To(Succeed())
+				Expect(loaded.Episodes[0].Response.Chunks).To(BeEmpty())
+			})
+		})
+
+		Context("with websockets", func() {
+			// sends each message and returns the answers, then closes the
+			// connection
+			converse := func(messages ...string) ([]string, error) {
+				conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%s/socket", proxyPort), nil)
+				if err != nil {
+					return nil, err
+				}
+				defer conn.Close()
+
+				answers := []string{}
+				for _, message := range messages {
+					if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+						return answers, err
+					}
+					_, answer, err := conn.ReadMessage()
+					if err != nil {
+						return answers, err
+					}
+					answers = append(answers, string(answer))
+				}
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						return answers, nil
+					}
+				}
+			}
+
+			BeforeEach(func() {
+				configureProxy(map[string]interface{}{"cassette": "test-cassette", "flush_interval_ms": 0})
+			})
+
+			It("records the messages in both directions", func() {
+				answers, err := converse("hello", "again")
+				Expect(err).To(BeNil())
+				Expect(answers).To(Equal([]string{"echo 1: hello", "echo 1: again"}))
+
+				loaded := Config{Cassette: "test-cassette", CassetteDir: cassetteDir}
+				Eventually(func() int {
+					loaded.Load()
+					return len(loaded.Episodes)
+				}).Should(Equal(1))
+				episode := loaded.Episodes[0]
+				Expect(episode.Response.StatusCode).To(Equal(101))
+				Expect(episode.WebSocketMessages).To(HaveLen(4))
+				Expect(episode.WebSocketMessages[0].From).To(Equal(FromClient))
+				Expect(string(episode.WebSocketMessages[0].Data)).To(Equal("hello"))
+				Expect(episode.WebSocketMessages[1].From).To(Equal(FromServer))
+				Expect(string(episode.WebSocketMessages[1].Data)).To(Equal("echo 1: hello"))
+			})
+
+			It("replays the recorded server messages without the target", func() {
+				converse("hello", "again")
+				Eventually(func() int {
+					loaded := Config{Cassette: "test-cassette", CassetteDir: cassetteDir}
+					loaded.Load()
+					return len(loaded.Episodes)
+				}).Should(Equal(1))
+				configureProxy(map[string]interface{}{"record_mode": "none"})
+
+				answers, err := converse("hello", "again")
+				Expect(err).To(BeNil())
+				Expect(answers).To(Equal([]string{"echo 1: hello", "echo 1: again"}))
+				Expect(atomic.LoadInt64(&requestCount)).To(BeNumerically("==", 1))
+			})
+
+			It("closes the connection when the client sends an unexpected message", func() {
+				converse("hello")
+				Eventually(func() int {
+					loaded := Config{Cassette: "test-cassette", CassetteDir: cassetteDir}
+					loaded.Load()
+					return len(loaded.Episodes)
+				}).Should(Equal(1))
+				configureProxy(map[string]interface{}{"record_mode": "none"})
+
+				_, err := converse("goodbye")
+				Expect(websocket.IsCloseError(err, websocket.ClosePolicyViolation)).To(BeTrue())
+			})
+		})
+
+		It("records and replays VCR YAML cassettes", func() {
+			configureProxy(map[string]interface{}{"cassette": "test-cassette", "cassette_format": "vcr_yaml", "flush_interval_ms": 0})
+
+			resp, _ := proxyGet("/request-count?page=1")
+			body, _ := ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("1 requests so far"))
+
+			cassetteData, err := ioutil.ReadFile(path.Join(cassetteDir, "test-cassette.yml"))
+			Expect(err).To(BeNil())
+			Expect(string(cassetteData)).To(ContainSubstring("http_interactions:"))
+			Expect(string(cassetteData)).To(ContainSubstring("string: 1 requests so far"))
+
+			configureProxy(map[string]interface{}{"cassette": "other-cassette", "cassette_format": "json"})
+			configureProxy(map[string]interface{}{"cassette": "test-cassette", "record_mode": "none"})
+
+			resp, _ = proxyGet("/request-count?page=1")
+			body, _ = ioutil.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("1 requests so far"))
+		})
+
+		It("writes new cassettes in the configured format while another format is inserted", func() {
+			configureProxy(map[string]interface{}{"cassette": "test-cassette", "cassette_format": "vcr_yaml", "flush_interval_ms": 0})
+			proxyGet("/request-count")
+			configureProxy(map[string]interface{}{"cassette": "test-cassette", "cassette_format": "json"})
+
+			resp, _ := proxyGet("/__betamax__/config")
+			var config map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&config)
+			Expect(config["cassette_format"]).To(Equal("json"))
+
+			proxyGet("/request-count?page=2")
+			_, err := os.Stat(path.Join(cassetteDir, "test-cassette.json"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			configureProxy(map[string]interface{}{"cassette": "other-cassette"})
+			proxyGet("/request-count")
+			_, err = os.Stat(path.Join(cassetteDir, "other-cassette.json"))
+			Expect(err).To(BeNil())
+		})
+
 		It("write cassettes to disk", func() {
 			configureProxy(map[string]interface{}{"cassette": "test-cassette"})
 
 			proxyGet("/")
 
-			cassetteData, err := ioutil.ReadFile(path.Join(cassetteDir, "test-cassette.json"))
-			Expect(err).To(BeNil())
+			var cassetteData []byte
+			Eventually(func() (err error) {
+				cassetteData, err = ioutil.ReadFile(path.Join(cassetteDir, "test-cassette.json"))
+				return
+			}).Should(Succeed())
 			Expect(cassetteData).ToNot(BeEmpty())
 
-			var cassetteJson []map[string]interface{}
-			err = json.Unmarshal(cassetteData, &cassetteJson)
+			var cassetteJson map[string]interface{}
+			err := json.Unmarshal(cassetteData, &cassetteJson)
 			Expect(err).To(BeNil())
-			Expect(cassetteJson).ToNot(BeEmpty())
+			Expect(cassetteJson["format_version"]).To(BeNumerically("==", CassetteFormatVersion))
+			Expect(cassetteJson["betamax_version"]).To(Equal(Version))
+			Expect(cassetteJson["target_url"]).To(Equal(targetUrl.String()))
+			Expect(cassetteJson["episodes"]).ToNot(BeEmpty())
 
-			episode := cassetteJson[0]
+			episode := cassetteJson["episodes"].([]interface{})[0].(map[string]interface{})
 			Expect(episode["Request"]).ToNot(BeEmpty())
 			Expect(episode["Response"]).ToNot(BeEmpty())
+			Expect(episode["RecordedAt"]).ToNot(BeEmpty())
+			Expect(episode["Duration"]).ToNot(BeEmpty())
 		})
 
 		It("switches cassettes on demand", func() {
@@ -347,6 +1745,106 @@ var _ = Describe("Proxy", func() {
 			Expect(string(body)).To(Equal(fmt.Sprintf("127.0.0.1:%s", proxyPort)))
 		})
 
+		It("handles concurrent requests, recordings and config updates", func() {
+			configureProxy(map[string]interface{}{"cassette": "test-cassette"})
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(2)
+				go func(i int) {
+					defer wg.Done()
+					resp, err := proxyGet(fmt.Sprintf("/request-count?n=%d", i%5))
+					if err == nil {
+						ioutil.ReadAll(resp.Body)
+						resp.Body.Close()
+					}
+				}(i)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					configureProxy(map[string]interface{}{"match_headers": []string{fmt.Sprintf("X-Header-%d", i)}})
+				}(i)
+			}
+			wg.Wait()
+
+			var cassette WriteableCassette
+			Eventually(func() int {
+				cassetteData, _ := ioutil.ReadFile(path.Join(cassetteDir, "test-cassette.json"))
+				json.Unmarshal(cassetteData, &cassette)
+				return len(cassette.Episodes)
+			}).Should(BeNumerically(">=", 5))
+
+			for _, episode := range cassette.Episodes {
+				Expect(episode.Request.URL.Path).To(Equal("/request-count"))
+			}
+		})
+
+		It("batches writes and flushes pending episodes when switching cassettes", func() {
+			configureProxy(map[string]interface{}{"cassette": "first-cassette", "flush_interval_ms": 60000})
+
+			proxyGet("/")
+			_, err := os.Stat(path.Join(cassetteDir, "first-cassette.json"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			configureProxy(map[string]interface{}{"cassette": "second-cassette"})
+			_, err = os.Stat(path.Join(cassetteDir, "first-cassette.json"))
+			Expect(err).To(BeNil())
+		})
+
+		It("writes the pending episodes of every session on Flush", func() {
+			configureProxy(map[string]interface{}{"cassette": "first-cassette", "flush_interval_ms": 60000})
+			resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%s/__betamax__/sessions", proxyPort), "application/json",
+				strings.NewReader(`{"name": "worker", "config": {"cassette": "worker-cassette"}}`))
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(201))
+
+			proxyGet("/")
+			proxyGetWithHeaders("/", map[string]string{"X-Betamax-Session": "worker"})
+			_, err = os.Stat(path.Join(cassetteDir, "worker-cassette.json"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			Expect(Flush(proxy)).To(Succeed())
+			_, err = os.Stat(path.Join(cassetteDir, "first-cassette.json"))
+			Expect(err).To(BeNil())
+			_, err = os.Stat(path.Join(cassetteDir, "worker-cassette.json"))
+			Expect(err).To(BeNil())
+		})
+
+		It("keeps episodes recorded by another proxy sharing the cassette directory", func() {
+			otherListener, _ := net.Listen("tcp", "127.0.0.1:0")
+			defer otherListener.Close()
+			go http.Serve(otherListener, Proxy(targetUrl, cassetteDir))
+
+			for _, address := range []string{"127.0.0.1:" + proxyPort, otherListener.Addr().String()} {
+				jsonBytes, _ := json.Marshal(map[string]interface{}{"cassette": "shared-cassette", "flush_interval_ms": 0})
+				_, err := http.Post("http://"+address+"/__betamax__/config", "text/json", bytes.NewBuffer(jsonBytes))
+				Expect(err).To(BeNil())
+			}
+
+			proxyGet("/request-count")
+			_, err := http.Get("http://" + otherListener.Addr().String() + "/echo-host")
+			Expect(err).To(BeNil())
+
+			cassetteData, err := ioutil.ReadFile(path.Join(cassetteDir, "shared-cassette.json"))
+			Expect(err).To(BeNil())
+			var cassette WriteableCassette
+			Expect(json.Unmarshal(cassetteData, &cassette)).To(Succeed())
+			Expect(cassette.Episodes).To(HaveLen(2))
+		})
+
+		It("refuses to load a corrupt cassette", func() {
+			os.MkdirAll(cassetteDir, 0700)
+			ioutil.WriteFile(path.Join(cassetteDir, "corrupt.json"), []byte(`[{"Request": {`), 0700)
+
+			jsonBytes, _ := json.Marshal(map[string]interface{}{"cassette": "corrupt"})
+			resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%s/__betamax__/config", proxyPort), "text/json", bytes.NewBuffer(jsonBytes))
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(500))
+
+			data, _ := ioutil.ReadFile(path.Join(cassetteDir, "corrupt.json"))
+			Expect(string(data)).To(Equal(`[{"Request": {`))
+		})
+
 		It("ignores the content-boundary multipart forms", func() {
 			configureProxy(map[string]interface{}{"cassette": "test-cassette"})
 
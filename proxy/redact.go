@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+const DefaultRedactionPlaceholder = "[REDACTED]"
+
+// Redactions describe secrets that must never be written into a cassette.
+// Recorded episodes get the selected values replaced by a placeholder, and
+// live requests are redacted the same way before they are matched, so
+// redacted episodes still replay.
+type Redactions struct {
+	// request and response headers, like Authorization or Set-Cookie
+	Headers     []string `json:"headers"`
+	QueryParams []string `json:"query_params"`
+	// fields of url-encoded and multipart form bodies
+	FormFields []string `json:"form_fields"`
+	// JSONPath-style expressions selecting values in JSON bodies
+	JSONPaths []string `json:"json_paths"`
+	// regular expressions for secrets in text bodies. if an expression has
+	// capture groups only the groups are replaced, otherwise the whole match.
+	BodyPatterns []string `json:"body_patterns"`
+	// DefaultRedactionPlaceholder if empty
+	Placeholder string `json:"placeholder"`
+
+	// BodyPatterns, compiled by validate
+	bodyPatterns []*regexp.Regexp
+}
+
+func (r *Redactions) empty() bool {
+	return len(r.Headers) == 0 && len(r.QueryParams) == 0 && len(r.FormFields) == 0 &&
+		len(r.JSONPaths) == 0 && len(r.BodyPatterns) == 0
+}
+
+// whether any redactions look into bodies
+func (r *Redactions) redactsBodies() bool {
+	return len(r.FormFields) > 0 || len(r.JSONPaths) > 0 || len(r.BodyPatterns) > 0
+}
+
+func (r *Redactions) validate() error {
+	for _, expr := range r.JSONPaths {
+		if _, err := parseJSONPath(expr); err != nil {
+			return err
+		}
+	}
+	bodyPatterns := []*regexp.Regexp{}
+	for _, pattern := range r.BodyPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		bodyPatterns = append(bodyPatterns, re)
+	}
+	r.bodyPatterns = bodyPatterns
+	return nil
+}
+
+func (r *Redactions) compiledBodyPatterns() []*regexp.Regexp {
+	if r.bodyPatterns != nil {
+		return r.bodyPatterns
+	}
+	// redactions set up in Go rather than through JSON were never validated
+	bodyPatterns := []*regexp.Regexp{}
+	for _, pattern := range r.BodyPatterns {
+		if re, err := regexp.Compile(pattern); err == nil {
+			bodyPatterns = append(bodyPatterns, re)
+		}
+	}
+	return bodyPatterns
+}
+
+func (r *Redactions) placeholder() string {
+	if r.Placeholder == "" {
+		return DefaultRedactionPlaceholder
+	}
+	return r.Placeholder
+}
+
+// returns a redacted copy of the request; the original is left untouched
+// since it may still be on its way to the target
+func (r *Redactions) redactRequest(req RecordedRequest) RecordedRequest {
+	if r.empty() {
+		return req
+	}
+
+	redacted := req
+	redacted.Header = r.redactHeader(req.Header)
+	if req.URL != nil {
+		u := *req.URL
+		u.RawQuery = r.redactQuery(u.RawQuery)
+		redacted.URL = &u
+	}
+	redacted.Body = r.redactForm(req.Body, req.Header)
+	redacted.Body = r.redactBody(redacted.Body, req.Header)
+	redacted.Header = fixContentLength(redacted.Header, req.Body, redacted.Body)
+	// the form is parsed from the query and body, so parse it again
+	// rather than redacting it separately
+	redacted.Form, _ = peekForm(redacted.httpRequest())
+	return redacted
+}
+
+// returns a redacted copy of the response
+func (r *Redactions) redactResponse(resp RecordedResponse) RecordedResponse {
+	if r.empty() {
+		return resp
+	}
+
+	redacted := resp
+	redacted.Header = r.redactHeader(resp.Header)
+	if len(resp.Chunks) == 0 || len(resp.Body) == 0 {
+		redacted.Body = r.redactBody(resp.Body, resp.Header)
+		redacted.Header = fixContentLength(redacted.Header, resp.Body, redacted.Body)
+		return redacted
+	}
+
+	// streamed bodies are redacted chunk by chunk, so the chunks still
+	// add up to the body
+	redacted.Body = nil
+	redacted.Chunks = make([]Chunk, len(resp.Chunks))
+	offset := 0
+	for i, chunk := range resp.Chunks {
+		end := offset + chunk.Size
+		if end > len(resp.Body) {
+			end = len(resp.Body)
+		}
+		body := r.redactBody(resp.Body[offset:end], resp.Header)
+		redacted.Body = append(redacted.Body, body...)
+		redacted.Chunks[i] = Chunk{Size: len(body), Elapsed: chunk.Elapsed}
+		offset = end
+	}
+	redacted.Body = append(redacted.Body, r.redactBody(resp.Body[offset:], resp.Header)...)
+	redacted.Header = fixContentLength(redacted.Header, resp.Body, redacted.Body)
+	return redacted
+}
+
+// returns header with its Content-Length set to the length of a body that
+// redactions rewrote from original, so replaying the body doesn't cut it
+// off. the header is copied, since it may be the live one.
+func fixContentLength(header http.Header, original []byte, body []byte) http.Header {
+	if len(body) == len(original) || header.Get("Content-Length") == "" {
+		return header
+	}
+	fixed := http.Header{}
+	for key, values := range header {
+		fixed[key] = values
+	}
+	fixed.Set("Content-Length", strconv.Itoa(len(body)))
+	return fixed
+}
+
+func (r *Redactions) redactHeader(header http.Header) http.Header {
+	if len(r.Headers) == 0 || header == nil {
+		return header
+	}
+
+	redacted := http.Header{}
+	for key, values := range header {
+		redacted[key] = values
+	}
+	for _, name := range r.Headers {
+		key := http.CanonicalHeaderKey(name)
+		if values, ok := redacted[key]; ok {
+			redacted[key] = r.placeholders(len(values))
+		}
+	}
+	return redacted
+}
+
+func (r *Redactions) redactQuery(rawQuery string) string {
+	if len(r.QueryParams) == 0 || rawQuery == "" {
+		return rawQuery
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	redacted, changed := r.redactValues(query, r.QueryParams)
+	if !changed {
+		return rawQuery
+	}
+	return url.Values(redacted).Encode()
+}
+
+// returns a copy of values with the named keys redacted, or values itself
+// if none of them are present
+func (r *Redactions) redactValues(values map[string][]string, names []string) (map[string][]string, bool) {
+	var redacted map[string][]string
+	for _, name := range names {
+		if _, ok := values[name]; !ok {
+			continue
+		}
+		if redacted == nil {
+			redacted = map[string][]string{}
+			for key, value := range values {
+				redacted[key] = value
+			}
+		}
+		redacted[name] = r.placeholders(len(values[name]))
+	}
+	if redacted == nil {
+		return values, false
+	}
+	return redacted, true
+}
+
+func (r *Redactions) placeholders(n int) []string {
+	values := make([]string, n)
+	for i := range values {
+		values[i] = r.placeholder()
+	}
+	return values
+}
+
+// redacts form fields in url-encoded and multipart request bodies
+func (r *Redactions) redactForm(body []byte, header http.Header) []byte {
+	if len(r.FormFields) == 0 || len(body) == 0 {
+		return body
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return body
+		}
+		if redacted, changed := r.redactValues(form, r.FormFields); changed {
+			return []byte(url.Values(redacted).Encode())
+		}
+	case "multipart/form-data":
+		return r.redactMultipart(body, params["boundary"])
+	}
+	return body
+}
+
+// rewrites a multipart body part by part, keeping the boundary so the
+// Content-Type header stays valid
+func (r *Redactions) redactMultipart(body []byte, boundary string) []byte {
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return body
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body
+		}
+
+		partWriter, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return body
+		}
+		if part.FileName() == "" && contains(r.FormFields, part.FormName()) {
+			io.WriteString(partWriter, r.placeholder())
+		} else {
+			io.Copy(partWriter, part)
+		}
+	}
+	writer.Close()
+	return buf.Bytes()
+}
+
+// redacts JSON paths in JSON bodies and body patterns in text bodies
+func (r *Redactions) redactBody(body []byte, header http.Header) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	if len(r.JSONPaths) > 0 && IsJSON(header) {
+		var doc interface{}
+		if json.Unmarshal(body, &doc) == nil {
+			for _, expr := range r.JSONPaths {
+				steps, _ := parseJSONPath(expr)
+				rewriteJSONPath(doc, steps, func(interface{}) (interface{}, bool) {
+					return r.placeholder(), true
+				})
+			}
+			if redacted, err := json.Marshal(doc); err == nil {
+				body = redacted
+			}
+		}
+	}
+
+	if len(r.BodyPatterns) > 0 && IsText(header) {
+		for _, re := range r.compiledBodyPatterns() {
+			body = replaceMatches(re, body, []byte(r.placeholder()))
+		}
+	}
+	return body
+}
+
+// replaces the capture groups of every match of re, or the whole match if
+// re has no groups
+func replaceMatches(re *regexp.Regexp, body []byte, replacement []byte) []byte {
+	var buf bytes.Buffer
+	last := 0
+	for _, match := range re.FindAllSubmatchIndex(body, -1) {
+		spans := match[2:]
+		if len(spans) == 0 {
+			spans = match[:2]
+		}
+		for i := 0; i < len(spans); i += 2 {
+			start, end := spans[i], spans[i+1]
+			if start < last {
+				// group did not participate, or is nested in one already replaced
+				continue
+			}
+			buf.Write(body[last:start])
+			buf.Write(replacement)
+			last = end
+		}
+	}
+	buf.Write(body[last:])
+	return buf.Bytes()
+}
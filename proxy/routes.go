@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Route sends the requests matching its Host and/or PathPrefix to Target
+// instead of the proxy's default target. Routes are tried in order and the
+// first match wins.
+type Route struct {
+	// identifies the route in episodes, defaults to Target
+	Name string `json:"name"`
+	// matched against the Host header, with or without the port
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix"`
+	// remove PathPrefix from the path before proxying
+	StripPrefix bool   `json:"strip_prefix"`
+	Target      string `json:"target"`
+}
+
+// fills in defaults and checks the route makes sense
+func (r *Route) normalize() error {
+	target, err := url.Parse(r.Target)
+	if err != nil {
+		return fmt.Errorf("route target %q is not a valid url: %s", r.Target, err)
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return fmt.Errorf("route target %q must be an absolute url", r.Target)
+	}
+	if r.Host == "" && r.PathPrefix == "" {
+		return fmt.Errorf("route to %q needs a host or a path_prefix", r.Target)
+	}
+	if r.Name == "" {
+		r.Name = r.Target
+	}
+	return nil
+}
+
+// ParseRoute parses a route given as <path prefix>=<target url> or
+// <host>=<target url>, as in -route /billing=http://localhost:9000
+func ParseRoute(spec string) (Route, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return Route{}, fmt.Errorf("route %q is not of the form <host or /path prefix>=<target url>", spec)
+	}
+
+	route := Route{Target: parts[1]}
+	if strings.HasPrefix(parts[0], "/") {
+		route.PathPrefix = parts[0]
+	} else {
+		route.Host = parts[0]
+	}
+	return route, route.normalize()
+}
+
+func (r *Route) matches(req *http.Request) bool {
+	if r.Host != "" && r.Host != req.Host {
+		hostname, _, err := net.SplitHostPort(req.Host)
+		if err != nil || hostname != r.Host {
+			return false
+		}
+	}
+	return r.matchesPath(req.URL.Path)
+}
+
+// a prefix matches whole path segments, so /billing matches /billing and
+// /billing/invoices but not /billing-v2
+func (r *Route) matchesPath(path string) bool {
+	prefix := strings.TrimSuffix(r.PathPrefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func (r *Route) targetHost() string {
+	target, _ := url.Parse(r.Target)
+	return target.Host
+}
+
+func findRoute(req *http.Request, config *Config) *Route {
+	for i := range config.Routes {
+		if config.Routes[i].matches(req) {
+			return &config.Routes[i]
+		}
+	}
+	return nil
+}
+
+type routeContextKey struct{}
+
+// the route picked for a request travels with it in its context, so the
+// recorder, the matchers and the upstream handler all agree on it
+func withRoute(req *http.Request, route *Route) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeContextKey{}, route))
+}
+
+func requestRoute(req *http.Request) *Route {
+	route, _ := req.Context().Value(routeContextKey{}).(*Route)
+	return route
+}
+
+// the name of the route a request was sent through, empty for the
+// default target
+func requestTarget(req *http.Request) string {
+	if route := requestRoute(req); route != nil {
+		return route.Name
+	}
+	return ""
+}
+
+// picks the route for each request
+func routeHandler(handler http.Handler, store *store) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if route := findRoute(req, store.Config()); route != nil {
+			req = withRoute(req, route)
+		}
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// sends requests to the target of their route, or to defaultTarget
+func routingHandler(defaultTarget http.Handler) http.Handler {
+	var mu sync.Mutex
+	proxies := map[string]http.Handler{}
+
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		route := requestRoute(req)
+		if route == nil {
+			defaultTarget.ServeHTTP(resp, req)
+			return
+		}
+
+		mu.Lock()
+		proxy, ok := proxies[route.Target]
+		if !ok {
+			target, _ := url.Parse(route.Target)
+			proxy = newReverseProxy(target)
+			proxies[route.Target] = proxy
+		}
+		mu.Unlock()
+
+		if route.StripPrefix {
+			// strip a copy, episodes keep the path the client asked for
+			stripped := *req.URL
+			stripped.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, route.PathPrefix), "/")
+			stripped.RawPath = ""
+			req = req.WithContext(req.Context())
+			req.URL = &stripped
+		}
+		proxy.ServeHTTP(resp, req)
+	})
+}
+
+// GET lists the routes, POST adds a route or replaces the one with the
+// same name, and DELETE with ?name= removes one
+func handleTargetsRequest(resp http.ResponseWriter, req *http.Request, store *store) {
+	switch req.Method {
+	case "GET":
+		writeJSON(resp, store.Config().Routes)
+	case "POST":
+		var route Route
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&route); err != nil {
+			jsonError(resp, err.Error(), 400)
+			return
+		}
+		if err := route.normalize(); err != nil {
+			jsonError(resp, err.Error(), 400)
+			return
+		}
+		store.update(func(config *Config) error {
+			routes := []Route{}
+			replaced := false
+			for _, existing := range config.Routes {
+				if existing.Name == route.Name {
+					existing, replaced = route, true
+				}
+				routes = append(routes, existing)
+			}
+			if !replaced {
+				routes = append(routes, route)
+			}
+			config.Routes = routes
+			return nil
+		})
+		writeJSON(resp, store.Config().Routes)
+	case "DELETE":
+		name := req.URL.Query().Get("name")
+		found := false
+		store.update(func(config *Config) error {
+			routes := []Route{}
+			for _, existing := range config.Routes {
+				if existing.Name == name {
+					found = true
+					continue
+				}
+				routes = append(routes, existing)
+			}
+			config.Routes = routes
+			return nil
+		})
+		if !found {
+			jsonError(resp, fmt.Sprintf("no route named %q", name), 404)
+			return
+		}
+		writeJSON(resp, store.Config().Routes)
+	default:
+		resp.Header().Set("Allow", "GET, POST, DELETE")
+		jsonError(resp, fmt.Sprintf("method %s not allowed", req.Method), 405)
+	}
+}
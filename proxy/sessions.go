@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SessionHeader picks the session a request belongs to. Requests without
+// it use the default session.
+const SessionHeader = "X-Betamax-Session"
+
+const sessionsPath = "/__betamax__/sessions"
+
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// sessions give clients sharing one proxy, like parallel test workers,
+// configurations of their own: each session has its own cassette, record
+// mode and playback state. A session is picked with SessionHeader, or by
+// sending requests to the port the session listens on. Sessions are
+// created with a POST to /__betamax__/config naming a new session, and
+// ended with a DELETE; /__betamax__/sessions lists them and creates
+// sessions on ports of their own.
+type sessions struct {
+	upstream       http.Handler
+	defaultStore   *store
+	defaultHandler http.Handler
+	// serves the requests arriving on the ports of sessions; the forward
+	// proxy puts its CONNECT handling in front
+	root http.Handler
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	store   *store
+	handler http.Handler
+	// nil unless the session listens on a port of its own
+	listener net.Listener
+	server   *http.Server
+}
+
+// SessionInfo describes a session in the responses of the sessions API.
+type SessionInfo struct {
+	Name     string `json:"name"`
+	Cassette string `json:"cassette"`
+	// the port the session listens on, if it has one
+	Port int `json:"port,omitempty"`
+}
+
+func newSessions(upstream http.Handler, defaultStore *store) *sessions {
+	s := &sessions{
+		upstream:       upstream,
+		defaultStore:   defaultStore,
+		defaultHandler: sessionHandler(upstream, defaultStore),
+		sessions:       map[string]*session{},
+	}
+	s.root = s
+	return s
+}
+
+type sessionContextKey struct{}
+
+func (s *sessions) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == sessionsPath || strings.HasPrefix(req.URL.Path, sessionsPath+"/") {
+		s.handleSessionsRequest(resp, req)
+		return
+	}
+
+	name, onPort := req.Context().Value(sessionContextKey{}).(string)
+	if name == "" {
+		name = req.Header.Get(SessionHeader)
+	}
+	// the header is neither sent upstream nor recorded
+	req.Header.Del(SessionHeader)
+	if name == "" {
+		s.defaultHandler.ServeHTTP(resp, req)
+		return
+	}
+	if !onPort && req.URL.Path == "/__betamax__/config" {
+		if req.Method == "DELETE" {
+			s.handleEndRequest(resp, name)
+			return
+		}
+		if req.Method == "POST" && s.handleCreateConfigRequest(resp, req, name) {
+			return
+		}
+	}
+
+	s.mu.Lock()
+	session := s.sessions[name]
+	s.mu.Unlock()
+	if session == nil {
+		jsonError(resp, fmt.Sprintf("betamax: no session %q", name), 404)
+		return
+	}
+	session.handler.ServeHTTP(resp, req)
+}
+
+// a POST to /__betamax__/config naming a session that doesn't exist yet
+// creates it with the posted settings. returns false if the session
+// exists, leaving the request to its config endpoint.
+func (s *sessions) handleCreateConfigRequest(resp http.ResponseWriter, req *http.Request, name string) bool {
+	s.mu.Lock()
+	_, exists := s.sessions[name]
+	s.mu.Unlock()
+	if exists {
+		return false
+	}
+
+	settings, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		jsonError(resp, err.Error(), 400)
+		return true
+	}
+	session, err := s.create(name, nil, settings)
+	if err != nil {
+		jsonError(resp, err.Error(), sessionErrorStatus(err))
+		return true
+	}
+	config := session.store.Config()
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(201)
+	json.NewEncoder(resp).Encode(map[string]interface{}{"config": config, "episodes": len(config.Episodes)})
+	return true
+}
+
+func (s *sessions) handleEndRequest(resp http.ResponseWriter, name string) {
+	if !s.end(name) {
+		jsonError(resp, fmt.Sprintf("no session %q", name), 404)
+		return
+	}
+	resp.WriteHeader(204)
+}
+
+// GET lists the sessions, POST creates one and DELETE
+// /__betamax__/sessions/<name> ends one
+func (s *sessions) handleSessionsRequest(resp http.ResponseWriter, req *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, sessionsPath), "/")
+
+	switch {
+	case name == "" && req.Method == "GET":
+		writeJSON(resp, s.list())
+	case name == "" && req.Method == "POST":
+		payload := struct {
+			Name string `json:"name"`
+			// listen on this port as well, 0 for any free port
+			Port *int `json:"port"`
+			// settings of the new session, as for /__betamax__/config
+			Config json.RawMessage `json:"config"`
+		}{}
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&payload); err != nil {
+			jsonError(resp, err.Error(), 400)
+			return
+		}
+		session, err := s.create(payload.Name, payload.Port, payload.Config)
+		if err != nil {
+			jsonError(resp, err.Error(), sessionErrorStatus(err))
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(201)
+		json.NewEncoder(resp).Encode(session.info(payload.Name))
+	case name != "" && req.Method == "DELETE":
+		s.handleEndRequest(resp, name)
+	default:
+		jsonError(resp, fmt.Sprintf("method %s not allowed", req.Method), 405)
+	}
+}
+
+// an error from create to answer with a status other than 400
+type sessionError struct {
+	error
+	status int
+}
+
+// the status to answer an error from create with
+func sessionErrorStatus(err error) int {
+	if sessionErr, ok := err.(sessionError); ok {
+		return sessionErr.status
+	}
+	return 400
+}
+
+// starts a session with the settings of the default session, but no
+// cassette inserted, and the given settings on top
+func (s *sessions) create(name string, port *int, settings json.RawMessage) (*session, error) {
+	if !sessionNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid session name %q", name)
+	}
+
+	// a deep copy, so the sessions share no slices
+	config := s.defaultStore.Config().clone()
+	config.Cassette, config.Episodes, config.cassetteExisted = "", nil, false
+	if len(settings) > 0 {
+		if err := json.Unmarshal(settings, config); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.Load(); err != nil && !os.IsNotExist(err) {
+		return nil, sessionError{err, 500}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.sessions[name]; exists {
+		return nil, sessionError{fmt.Errorf("session %q exists already", name), 409}
+	}
+
+	session := &session{store: newStore(config)}
+	session.handler = sessionHandler(s.upstream, session.store)
+	if port != nil {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+		if err != nil {
+			return nil, sessionError{err, 500}
+		}
+		root := s.root
+		session.listener = listener
+		session.server = &http.Server{
+			Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				root.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, name)))
+			}),
+		}
+		go session.server.Serve(listener)
+	}
+	s.sessions[name] = session
+	return session, nil
+}
+
+// saves the episodes the session has recorded and stops it. returns false
+// if there is no such session.
+func (s *sessions) end(name string) bool {
+	s.mu.Lock()
+	session := s.sessions[name]
+	delete(s.sessions, name)
+	s.mu.Unlock()
+	if session == nil {
+		return false
+	}
+
+	if session.server != nil {
+		session.server.Close()
+	}
+	// ejecting the cassette writes what is pending, and keeps requests
+	// still in flight from recording into it afterwards
+	session.store.update(func(config *Config) error {
+		config.Cassette = ""
+		return nil
+	})
+	return true
+}
+
+// writes the pending episodes of the default session and all others
+func (s *sessions) flush() error {
+	err := s.defaultStore.Flush()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.sessions {
+		if sessionErr := session.store.Flush(); err == nil {
+			err = sessionErr
+		}
+	}
+	return err
+}
+
+func (s *sessions) list() []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := []SessionInfo{}
+	for name, session := range s.sessions {
+		infos = append(infos, session.info(name))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func (s *session) info(name string) SessionInfo {
+	info := SessionInfo{Name: name, Cassette: s.store.Config().Cassette}
+	if s.listener != nil {
+		info.Port = s.listener.Addr().(*net.TCPAddr).Port
+	}
+	return info
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// store guards the Config shared by the proxy's handlers. Readers get an
+// immutable snapshot; writers modify a copy and swap it in under the lock,
+// so concurrent requests never observe a half-applied change and never
+// race with recordings or config updates.
+//
+// Recorded episodes are batched and written to disk once FlushInterval
+// has passed since the first unsaved one, instead of rewriting the
+// cassette after every request.
+type store struct {
+	mu     sync.RWMutex
+	config *Config
+	// the configuration the store started with, which settings reset to
+	defaults *Config
+
+	// episodes recorded into the current cassette since the last flush
+	recorded   []recordedEpisode
+	flushTimer *time.Timer
+
+	// indexes of the episodes ordered playback has already served
+	played map[int]bool
+	// how many requests each fault rule has failed, by index
+	injected map[int]int
+}
+
+type recordedEpisode struct {
+	episode Episode
+	// index of the existing episode it re-records, or -1
+	replace int
+}
+
+func newStore(config *Config) *store {
+	return &store{config: config, defaults: config.clone()}
+}
+
+// returns the current configuration. callers must treat it as read-only.
+func (s *store) Config() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// applies fn to a deep copy of the current configuration and makes the copy
+// current, unless fn returns an error. updates are serialized, so fn always
+// sees the result of the previous update. pending episodes are flushed
+// first, so they are never lost or written into another cassette.
+func (s *store) update(fn func(config *Config) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.flushLocked(); err != nil {
+		// don't let a broken cassette block switching to another one
+		log.Printf("betamax: writing cassette %q failed, dropping %d episodes: %s", s.config.Cassette, len(s.recorded), err)
+		s.recorded = nil
+	}
+
+	next := s.config.clone()
+	if err := fn(next); err != nil {
+		return err
+	}
+
+	if next.rewind || next.Cassette != s.config.Cassette || next.CassetteDir != s.config.CassetteDir {
+		s.played = nil
+	}
+	if !reflect.DeepEqual(next.Faults, s.config.Faults) {
+		s.injected = nil
+	}
+	next.rewind = false
+	s.config = next
+	return nil
+}
+
+// picks the recorded episode to replay for req and returns it with its
+// index, or nil and -1 if there is none. without ordered playback this is
+// the first matching episode; with it, the first matching episode that has
+// not been played yet.
+func (s *store) playEpisode(req *http.Request, config *Config) (*Episode, int) {
+	if !config.OrderedPlayback {
+		if i := findEpisodeIndex(req, config); i >= 0 {
+			return &config.Episodes[i], i
+		}
+		return nil, -1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config = s.config
+	req = matchableRequest(req, config)
+
+	matching := []int{}
+	for i := range config.Episodes {
+		if sameRequest(&config.Episodes[i].Request, req, *config) {
+			matching = append(matching, i)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, -1
+	}
+
+	if s.played == nil {
+		s.played = map[int]bool{}
+	}
+	for _, i := range matching {
+		if !s.played[i] {
+			s.played[i] = true
+			return &config.Episodes[i], i
+		}
+	}
+
+	// every matching episode has been played. when recording, the request
+	// becomes the next episode in the sequence.
+	if config.recordsNewEpisodes() {
+		return nil, -1
+	}
+
+	switch config.PlaybackExhausted {
+	case PlaybackCycle:
+		for _, i := range matching[1:] {
+			delete(s.played, i)
+		}
+		return &config.Episodes[matching[0]], matching[0]
+	case PlaybackFail:
+		return nil, -1
+	}
+	last := matching[len(matching)-1]
+	return &config.Episodes[last], last
+}
+
+// the index of the episode a recording of req replaces, or -1 if it is a
+// new episode. record mode all replaces the episode playback would have
+// picked, so with ordered playback a sequence of requests replaces the
+// recorded sequence one by one instead of overwriting its first episode.
+func (s *store) replacedEpisode(req *http.Request, config *Config) int {
+	if config.RecordMode != RecordAll {
+		return -1
+	}
+	_, index := s.playEpisode(req, config)
+	return index
+}
+
+// records an episode into the named cassette, replacing the episode at
+// index replace if it is still one for the same request. the episode is
+// dropped if another cassette was inserted while its request was in flight.
+func (s *store) writeEpisode(cassette string, episode Episode, replace int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config.Cassette != cassette {
+		return
+	}
+
+	next := *s.config
+	index := next.addEpisode(episode, replace)
+	s.config = &next
+
+	// a freshly recorded episode counts as played, so ordered playback
+	// records a sequence of identical requests instead of replaying the first
+	if s.played == nil {
+		s.played = map[int]bool{}
+	}
+	s.played[index] = true
+
+	s.recorded = append(s.recorded, recordedEpisode{episode: episode, replace: replace})
+
+	if next.FlushInterval <= 0 {
+		s.flushLocked()
+	} else if s.flushTimer == nil {
+		s.flushTimer = time.AfterFunc(time.Duration(next.FlushInterval)*time.Millisecond, func() {
+			if err := s.Flush(); err != nil {
+				log.Printf("betamax: writing cassette %q failed: %s", cassette, err)
+			}
+		})
+	}
+}
+
+// writes any pending episodes to disk
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked()
+}
+
+func (s *store) flushLocked() error {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if len(s.recorded) == 0 {
+		return nil
+	}
+
+	next := *s.config
+	if err := next.saveRecorded(s.recorded); err != nil {
+		return err
+	}
+	s.recorded = nil
+	s.config = &next
+	return nil
+}
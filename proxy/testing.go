@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultTestCassetteDir is where test servers keep their cassettes unless
+// told otherwise, relative to the package under test.
+const DefaultTestCassetteDir = "testdata/cassettes"
+
+// T is the part of *testing.T a TestServer uses; *testing.T and *testing.B
+// both satisfy it.
+type T interface {
+	Name() string
+	Helper()
+	Cleanup(func())
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// TestOption changes the configuration of a TestServer before it starts.
+type TestOption func(config *Config)
+
+// WithCassetteDir keeps the test's cassette in dir instead of
+// DefaultTestCassetteDir.
+func WithCassetteDir(dir string) TestOption {
+	return func(config *Config) {
+		config.CassetteDir = dir
+	}
+}
+
+// WithRecordMode sets the record mode, e.g. RecordNone on CI so tests fail
+// instead of reaching out to the target.
+func WithRecordMode(mode RecordMode) TestOption {
+	return func(config *Config) {
+		config.RecordMode = mode
+	}
+}
+
+// TestServer is a reverse proxy running inside a Go test, with the test's
+// cassette inserted.
+type TestServer struct {
+	// the proxy's address; point the code under test here instead of at
+	// the target
+	URL string
+
+	server *httptest.Server
+	store  *store
+
+	mu sync.Mutex
+	// requests that had no episode and could not be recorded
+	unmatched []string
+}
+
+// NewTestServer starts a proxy for target on an ephemeral port and inserts
+// a cassette named after the test. When the test finishes, the proxy is
+// stopped, the recorded episodes are saved and the cassette ejected, and
+// the test fails if any request had no episode to replay and could not be
+// recorded under the record mode.
+func NewTestServer(t T, target string, options ...TestOption) *TestServer {
+	t.Helper()
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		t.Fatalf("betamax: target %q is not a valid url: %s", target, err)
+		return nil
+	}
+
+	config := reverseProxyConfig(targetURL, DefaultTestCassetteDir)
+	config.Cassette = testCassetteName(t.Name())
+	for _, option := range options {
+		option(config)
+	}
+	if !config.RecordMode.Valid() {
+		t.Fatalf("betamax: unknown record mode %q", config.RecordMode)
+		return nil
+	}
+	if err := config.Load(); err != nil && !os.IsNotExist(err) {
+		t.Fatalf("betamax: loading cassette %q failed: %s", config.Cassette, err)
+		return nil
+	}
+
+	p := &TestServer{store: newStore(config)}
+	handler := newProxy(newReverseProxy(targetURL), p.store)
+	p.server = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(resp, req)
+		if resp.Header().Get("X-Betamax-Denied") == "true" {
+			p.mu.Lock()
+			p.unmatched = append(p.unmatched, req.Method+" "+req.URL.RequestURI())
+			p.mu.Unlock()
+		}
+	}))
+	p.URL = p.server.URL
+
+	t.Cleanup(func() {
+		p.server.Close()
+		cassette := p.store.Config().Cassette
+		if err := p.store.Flush(); err != nil {
+			t.Errorf("betamax: saving cassette %q failed: %s", cassette, err)
+		}
+		// connections that outlive the test, like hijacked websockets,
+		// must not record into the cassette afterwards
+		p.store.update(func(config *Config) error {
+			config.Cassette = ""
+			return nil
+		})
+		for _, request := range p.Unmatched() {
+			t.Errorf("betamax: no episode in cassette %q for %s", cassette, request)
+		}
+	})
+	return p
+}
+
+// Config returns the proxy's current configuration, including the episodes
+// of the cassette. It must be treated as read-only.
+func (p *TestServer) Config() *Config {
+	return p.store.Config()
+}
+
+// Unmatched returns the requests that had no episode to replay and could
+// not be recorded, as "<method> <request uri>".
+func (p *TestServer) Unmatched() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.unmatched...)
+}
+
+// subtests are named like "TestThing/case", which would put the cassette
+// in a subdirectory
+func testCassetteName(name string) string {
+	return strings.Replace(name, "/", "_", -1)
+}
@@ -0,0 +1,137 @@
+package proxy_test
+
+import (
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/thegreatape/betamax/proxy"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// stands in for *testing.T, collecting failures and cleanups
+type fakeT struct {
+	name     string
+	errors   []string
+	cleanups []func()
+}
+
+func (t *fakeT) Name() string      { return t.name }
+func (t *fakeT) Helper()           {}
+func (t *fakeT) Cleanup(fn func()) { t.cleanups = append(t.cleanups, fn) }
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+func (t *fakeT) Fatalf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *fakeT) finish() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
+
+var _ = Describe("TestServer", func() {
+	var targetServer *httptest.Server
+	var cassetteDir string
+	var requestCount int64
+
+	get := func(proxy *TestServer, path string) (int, string) {
+		resp, err := http.Get(proxy.URL + path)
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	BeforeEach(func() {
+		requestCount = 0
+		targetServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			count := atomic.AddInt64(&requestCount, 1)
+			io.WriteString(writer, fmt.Sprintf("%d requests so far", count))
+		}))
+		cassetteDir, _ = ioutil.TempDir("", "cassettes")
+	})
+
+	AfterEach(func() {
+		targetServer.Close()
+		os.RemoveAll(cassetteDir)
+	})
+
+	It("records into a cassette named after the test and saves it when the test finishes", func() {
+		t := &fakeT{name: "TestThings/first_case"}
+		proxy := NewTestServer(t, targetServer.URL, WithCassetteDir(cassetteDir))
+		Expect(proxy.Config().Cassette).To(Equal("TestThings_first_case"))
+
+		_, body := get(proxy, "/things")
+		Expect(body).To(Equal("1 requests so far"))
+		t.finish()
+		Expect(t.errors).To(BeEmpty())
+
+		_, err := os.Stat(path.Join(cassetteDir, "TestThings_first_case.json"))
+		Expect(err).To(BeNil())
+
+		replay := &fakeT{name: "TestThings/first_case"}
+		proxy = NewTestServer(replay, targetServer.URL, WithCassetteDir(cassetteDir), WithRecordMode(RecordNone))
+		_, body = get(proxy, "/things")
+		Expect(body).To(Equal("1 requests so far"))
+		replay.finish()
+		Expect(replay.errors).To(BeEmpty())
+		Expect(atomic.LoadInt64(&requestCount)).To(BeNumerically("==", 1))
+	})
+
+	It("fails the test on requests without an episode", func() {
+		t := &fakeT{name: "TestUnrecorded"}
+		proxy := NewTestServer(t, targetServer.URL, WithCassetteDir(cassetteDir), WithRecordMode(RecordNone))
+
+		status, _ := get(proxy, "/missing?page=2")
+		Expect(status).To(Equal(403))
+		Expect(proxy.Unmatched()).To(Equal([]string{"GET /missing?page=2"}))
+
+		t.finish()
+		Expect(t.errors).To(HaveLen(1))
+		Expect(t.errors[0]).To(ContainSubstring(`no episode in cassette "TestUnrecorded" for GET /missing?page=2`))
+	})
+
+	It("never changes a configuration it has handed out", func() {
+		t := &fakeT{name: "TestConfigUpdates"}
+		proxy := NewTestServer(t, targetServer.URL, WithCassetteDir(cassetteDir), func(config *Config) {
+			config.MatchHeaders = []string{"X-Header"}
+		})
+		defer t.finish()
+		config := proxy.Config()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body := fmt.Sprintf(`{"match_headers": ["X-Header-%d"]}`, i)
+				resp, err := http.Post(proxy.URL+"/__betamax__/config", "application/json", strings.NewReader(body))
+				if err == nil {
+					resp.Body.Close()
+				}
+			}(i)
+		}
+		for i := 0; i < 1000; i++ {
+			Expect(config.MatchHeaders).To(Equal([]string{"X-Header"}))
+		}
+		wg.Wait()
+		Expect(config.MatchHeaders).To(Equal([]string{"X-Header"}))
+		Expect(proxy.Config().MatchHeaders).To(HaveLen(1))
+	})
+
+	It("fails the test right away on a bad record mode", func() {
+		t := &fakeT{name: "TestBadMode"}
+		Expect(NewTestServer(t, targetServer.URL, WithCassetteDir(cassetteDir), WithRecordMode("sometimes"))).To(BeNil())
+		Expect(t.errors).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+)
+
+// Transport is an http.RoundTripper that records into and replays from
+// cassettes in-process, for clients that can be given an http.Client
+// instead of being pointed at the proxy. It follows the same record modes
+// and matching rules as the proxy and reads and writes the same cassette
+// files.
+//
+// Requests without an episode that the record mode does not allow to be
+// recorded get the proxy's 403 response with X-Betamax-Denied set. Errors
+// of the upstream transport are returned, and not recorded.
+type Transport struct {
+	store   *store
+	handler http.Handler
+	// sends the requests being recorded
+	upstream http.RoundTripper
+}
+
+// NewTransport returns a Transport with the cassette named in config
+// inserted, sending requests to be recorded through upstream, or
+// http.DefaultTransport if upstream is nil.
+func NewTransport(config Config, upstream http.RoundTripper) (*Transport, error) {
+	if upstream == nil {
+		upstream = http.DefaultTransport
+	}
+	if config.RecordMode == "" {
+		config.RecordMode = RecordNewEpisodes
+	}
+	if !config.RecordMode.Valid() {
+		return nil, fmt.Errorf("unknown record mode %q", config.RecordMode)
+	}
+	if config.Cassette != "" {
+		if err := config.Load(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	store := newStore(&config)
+	return &Transport{
+		store:    store,
+		handler:  cassetteHandler(roundTripHandler(upstream), store),
+		upstream: upstream,
+	}, nil
+}
+
+type roundTripErrorKey struct{}
+
+// sends requests through upstream and writes the responses back, like the
+// reverse proxies do for the proxy
+func roundTripHandler(upstream http.RoundTripper) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		upstreamResp, err := upstream.RoundTrip(req)
+		if err != nil {
+			if roundTripErr, ok := req.Context().Value(roundTripErrorKey{}).(*error); ok {
+				*roundTripErr = err
+			}
+			upstreamErrorHandler(resp, req, err)
+			return
+		}
+		defer upstreamResp.Body.Close()
+
+		for key, values := range upstreamResp.Header {
+			resp.Header()[key] = values
+		}
+		resp.WriteHeader(upstreamResp.StatusCode)
+		io.Copy(resp, upstreamResp.Body)
+	})
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.store.Config().Cassette == "" {
+		return t.upstream.RoundTrip(req)
+	}
+
+	// round trippers must not modify the request they are given. client
+	// requests carry the host in their URL, and may have no body.
+	outgoing := req.Clone(req.Context())
+	if outgoing.Host == "" {
+		outgoing.Host = outgoing.URL.Host
+	}
+	if outgoing.Body == nil {
+		outgoing.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	}
+
+	var roundTripErr error
+	ctx := context.WithValue(outgoing.Context(), upstreamFailedKey{}, new(bool))
+	ctx = context.WithValue(ctx, roundTripErrorKey{}, &roundTripErr)
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, outgoing.WithContext(ctx))
+	if roundTripErr != nil {
+		return nil, roundTripErr
+	}
+
+	resp := recorder.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// Flush writes the episodes recorded since the last flush into the
+// cassette. With a FlushInterval, episodes are batched like in the proxy,
+// so Flush should be called before the cassette is read elsewhere.
+func (t *Transport) Flush() error {
+	return t.store.Flush()
+}
+
+// Config returns the transport's current configuration, including the
+// episodes of the cassette. It must be treated as read-only.
+func (t *Transport) Config() *Config {
+	return t.store.Config()
+}
+
+// Client returns an http.Client using the transport.
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
@@ -0,0 +1,88 @@
+package proxy_test
+
+import (
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/thegreatape/betamax/proxy"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var _ = Describe("Transport", func() {
+	var targetServer *httptest.Server
+	var cassetteDir string
+	var requestCount int64
+
+	read := func(resp *http.Response, err error) string {
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	newTransport := func(recordMode RecordMode) *Transport {
+		transport, err := NewTransport(Config{Cassette: "transport", CassetteDir: cassetteDir, RecordMode: recordMode}, nil)
+		Expect(err).To(BeNil())
+		return transport
+	}
+
+	BeforeEach(func() {
+		requestCount = 0
+		targetServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			count := atomic.AddInt64(&requestCount, 1)
+			body, _ := ioutil.ReadAll(request.Body)
+			io.WriteString(writer, fmt.Sprintf("%d requests so far%s", count, body))
+		}))
+		cassetteDir, _ = ioutil.TempDir("", "cassettes")
+	})
+
+	AfterEach(func() {
+		targetServer.Close()
+		os.RemoveAll(cassetteDir)
+	})
+
+	It("records and replays requests of an http.Client", func() {
+		client := newTransport(RecordNewEpisodes).Client()
+		Expect(read(client.Get(targetServer.URL + "/things"))).To(Equal("1 requests so far"))
+		Expect(read(client.Post(targetServer.URL+"/things", "text/plain", strings.NewReader(", posted")))).To(Equal("2 requests so far, posted"))
+
+		client = newTransport(RecordNone).Client()
+		Expect(read(client.Get(targetServer.URL + "/things"))).To(Equal("1 requests so far"))
+		Expect(read(client.Post(targetServer.URL+"/things", "text/plain", strings.NewReader(", posted")))).To(Equal("2 requests so far, posted"))
+		Expect(atomic.LoadInt64(&requestCount)).To(BeNumerically("==", 2))
+
+		resp, err := client.Get(targetServer.URL + "/other")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(403))
+		Expect(resp.Header.Get("X-Betamax-Denied")).To(Equal("true"))
+	})
+
+	It("writes cassettes the proxy can replay", func() {
+		client := newTransport(RecordNewEpisodes).Client()
+		Expect(read(client.Get(targetServer.URL + "/things?page=1"))).To(Equal("1 requests so far"))
+
+		targetUrl, _ := url.Parse(targetServer.URL)
+		proxyServer := httptest.NewServer(Proxy(targetUrl, cassetteDir))
+		defer proxyServer.Close()
+		http.Post(proxyServer.URL+"/__betamax__/config", "text/json", strings.NewReader(`{"cassette": "transport", "record_mode": "none"}`))
+
+		Expect(read(http.Get(proxyServer.URL + "/things?page=1"))).To(Equal("1 requests so far"))
+		Expect(atomic.LoadInt64(&requestCount)).To(BeNumerically("==", 1))
+	})
+
+	It("returns upstream errors without recording them", func() {
+		transport := newTransport(RecordNewEpisodes)
+		targetServer.Close()
+
+		_, err := transport.Client().Get(targetServer.URL + "/things")
+		Expect(err).ToNot(BeNil())
+		Expect(transport.Config().Episodes).To(BeEmpty())
+	})
+})
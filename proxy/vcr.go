@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the cassette layout written by Ruby's VCR, so fixtures can be shared
+// with Ruby projects. the betamax_ fields carry what VCR has no place for;
+// VCR ignores them.
+type vcrCassette struct {
+	HTTPInteractions []vcrInteraction `yaml:"http_interactions"`
+	RecordedWith     string           `yaml:"recorded_with"`
+}
+
+type vcrInteraction struct {
+	Request                  vcrRequest            `yaml:"request"`
+	Response                 vcrResponse           `yaml:"response"`
+	RecordedAt               string                `yaml:"recorded_at"`
+	BetamaxDuration          string                `yaml:"betamax_duration,omitempty"`
+	BetamaxWebSocketMessages []vcrWebSocketMessage `yaml:"betamax_websocket_messages,omitempty"`
+}
+
+type vcrRequest struct {
+	Method        string              `yaml:"method"`
+	URI           string              `yaml:"uri"`
+	Body          vcrBody             `yaml:"body"`
+	Headers       map[string][]string `yaml:"headers"`
+	BetamaxTarget string              `yaml:"betamax_target,omitempty"`
+}
+
+type vcrResponse struct {
+	Status                 vcrStatus           `yaml:"status"`
+	Headers                map[string][]string `yaml:"headers"`
+	Body                   vcrBody             `yaml:"body"`
+	BetamaxContentEncoding string              `yaml:"betamax_content_encoding,omitempty"`
+	BetamaxChunks          []vcrChunk          `yaml:"betamax_chunks,omitempty"`
+}
+
+type vcrChunk struct {
+	Size    int    `yaml:"size"`
+	Elapsed string `yaml:"elapsed"`
+}
+
+type vcrWebSocketMessage struct {
+	From    string  `yaml:"from"`
+	Binary  bool    `yaml:"binary"`
+	Data    vcrBody `yaml:"data"`
+	Elapsed string  `yaml:"elapsed"`
+}
+
+type vcrStatus struct {
+	Code    int    `yaml:"code"`
+	Message string `yaml:"message"`
+}
+
+// VCR keeps valid UTF-8 bodies as strings and anything else base64 encoded
+type vcrBody struct {
+	Encoding     string  `yaml:"encoding"`
+	String       *string `yaml:"string,omitempty"`
+	Base64String string  `yaml:"base64_string,omitempty"`
+	// the blob file holding a body too large for the cassette
+	BetamaxBlob string `yaml:"betamax_blob,omitempty"`
+}
+
+type vcrYAMLFormat struct{}
+
+func (vcrYAMLFormat) Extensions() []string {
+	return []string{".yml", ".yaml"}
+}
+
+func (vcrYAMLFormat) Marshal(c Cassette) ([]byte, error) {
+	now := time.Now()
+	cassette := vcrCassette{
+		HTTPInteractions: make([]vcrInteraction, len(c.Episodes)),
+		RecordedWith:     "betamax " + Version,
+	}
+	for i, episode := range c.Episodes {
+		// VCR requires recorded_at
+		recordedAt := episode.RecordedAt
+		if recordedAt.IsZero() {
+			recordedAt = now
+		}
+
+		cassette.HTTPInteractions[i] = vcrInteraction{
+			Request: vcrRequest{
+				Method:        strings.ToLower(episode.Request.Method),
+				URI:           episode.Request.absoluteURL(),
+				Body:          newVCRBody(episode.Request.Body, episode.Request.BodyBlob),
+				Headers:       episode.Request.Header,
+				BetamaxTarget: episode.Request.Target,
+			},
+			Response: vcrResponse{
+				Status: vcrStatus{
+					Code:    episode.Response.StatusCode,
+					Message: http.StatusText(episode.Response.StatusCode),
+				},
+				Headers:                episode.Response.Header,
+				Body:                   newVCRBody(episode.Response.Body, episode.Response.BodyBlob),
+				BetamaxContentEncoding: episode.Response.ContentEncoding,
+				BetamaxChunks:          newVCRChunks(episode.Response.Chunks),
+			},
+			RecordedAt:               recordedAt.UTC().Format(http.TimeFormat),
+			BetamaxWebSocketMessages: newVCRWebSocketMessages(episode.WebSocketMessages),
+		}
+		if episode.Duration > 0 {
+			cassette.HTTPInteractions[i].BetamaxDuration = episode.Duration.String()
+		}
+	}
+
+	data, err := yaml.Marshal(&cassette)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("---\n"), data...), nil
+}
+
+func (vcrYAMLFormat) Unmarshal(data []byte) (Cassette, error) {
+	cassette := vcrCassette{}
+	if err := yaml.Unmarshal(data, &cassette); err != nil {
+		return Cassette{}, err
+	}
+
+	episodes := make([]Episode, len(cassette.HTTPInteractions))
+	for i, interaction := range cassette.HTTPInteractions {
+		uri, err := url.Parse(interaction.Request.URI)
+		if err != nil {
+			return Cassette{}, err
+		}
+		requestBody, err := interaction.Request.Body.bytes()
+		if err != nil {
+			return Cassette{}, err
+		}
+		responseBody, err := interaction.Response.Body.bytes()
+		if err != nil {
+			return Cassette{}, err
+		}
+
+		request := RecordedRequest{
+			Target:   interaction.Request.BetamaxTarget,
+			Method:   strings.ToUpper(interaction.Request.Method),
+			Host:     uri.Host,
+			URL:      uri,
+			Header:   vcrHeader(interaction.Request.Headers),
+			Body:     requestBody,
+			BodyBlob: interaction.Request.Body.BetamaxBlob,
+		}
+		request.Form, _ = peekForm(request.httpRequest())
+
+		episodes[i] = Episode{
+			Request: request,
+			Response: RecordedResponse{
+				StatusCode:      interaction.Response.Status.Code,
+				Header:          vcrHeader(interaction.Response.Headers),
+				Body:            responseBody,
+				ContentEncoding: interaction.Response.BetamaxContentEncoding,
+				BodyBlob:        interaction.Response.Body.BetamaxBlob,
+			},
+		}
+		episodes[i].RecordedAt, _ = time.Parse(http.TimeFormat, interaction.RecordedAt)
+		episodes[i].Duration, _ = time.ParseDuration(interaction.BetamaxDuration)
+		for _, chunk := range interaction.Response.BetamaxChunks {
+			elapsed, _ := time.ParseDuration(chunk.Elapsed)
+			episodes[i].Response.Chunks = append(episodes[i].Response.Chunks, Chunk{Size: chunk.Size, Elapsed: elapsed})
+		}
+		for _, message := range interaction.BetamaxWebSocketMessages {
+			data, err := message.Data.bytes()
+			if err != nil {
+				return Cassette{}, err
+			}
+			elapsed, _ := time.ParseDuration(message.Elapsed)
+			episodes[i].WebSocketMessages = append(episodes[i].WebSocketMessages,
+				WebSocketMessage{From: message.From, Binary: message.Binary, Data: data, Elapsed: elapsed})
+		}
+	}
+	return Cassette{Episodes: episodes}, nil
+}
+
+func newVCRChunks(chunks []Chunk) []vcrChunk {
+	var vcrChunks []vcrChunk
+	for _, chunk := range chunks {
+		vcrChunks = append(vcrChunks, vcrChunk{Size: chunk.Size, Elapsed: chunk.Elapsed.String()})
+	}
+	return vcrChunks
+}
+
+func newVCRWebSocketMessages(messages []WebSocketMessage) []vcrWebSocketMessage {
+	var vcrMessages []vcrWebSocketMessage
+	for _, message := range messages {
+		vcrMessages = append(vcrMessages, vcrWebSocketMessage{
+			From:    message.From,
+			Binary:  message.Binary,
+			Data:    newVCRBody(message.Data, ""),
+			Elapsed: message.Elapsed.String(),
+		})
+	}
+	return vcrMessages
+}
+
+func newVCRBody(body []byte, blob string) vcrBody {
+	if blob != "" {
+		return vcrBody{Encoding: "ASCII-8BIT", BetamaxBlob: blob}
+	}
+	if utf8.Valid(body) {
+		str := string(body)
+		return vcrBody{Encoding: "UTF-8", String: &str}
+	}
+	return vcrBody{
+		Encoding:     "ASCII-8BIT",
+		Base64String: base64.StdEncoding.EncodeToString(body),
+	}
+}
+
+func (b vcrBody) bytes() ([]byte, error) {
+	if b.Base64String != "" {
+		// Ruby's base64 encoder wraps lines
+		encoded := strings.Join(strings.Fields(b.Base64String), "")
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+	if b.String == nil {
+		return []byte{}, nil
+	}
+	return []byte(*b.String), nil
+}
+
+// cassettes written by Ruby may not use Go's canonical header names
+func vcrHeader(headers map[string][]string) http.Header {
+	header := http.Header{}
+	for name, values := range headers {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	return header
+}
@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sent by the client
+	FromClient = "client"
+	// sent by the upstream server
+	FromServer = "server"
+)
+
+// WebSocketMessage is a message sent over a recorded WebSocket connection.
+type WebSocketMessage struct {
+	// FromClient or FromServer
+	From   string
+	Binary bool
+	Data   []byte
+	// time from the handshake to the message
+	Elapsed time.Duration
+}
+
+// hop-by-hop headers, and the headers the websocket package sets itself on
+// the upstream handshake
+var webSocketHandshakeHeaders = []string{
+	"Upgrade", "Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer",
+	"Transfer-Encoding", "Sec-Websocket-Key", "Sec-Websocket-Version",
+	"Sec-Websocket-Extensions", "Sec-Websocket-Protocol",
+}
+
+var webSocketUpgrader = websocket.Upgrader{
+	// the proxy stands in for the upstream, which does its own origin checks
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// handles a WebSocket handshake like cassetteHandler handles other
+// requests: replays a recorded connection if there is one, and records
+// a new one if the record mode allows it
+func serveWebSocket(resp http.ResponseWriter, req *http.Request, store *store, config *Config) {
+	if config.replaysEpisodes() {
+		if episode, _ := store.playEpisode(req, config); episode != nil {
+			// the upstream refused the handshake when it was recorded
+			if episode.Response.StatusCode != http.StatusSwitchingProtocols {
+				serveEpisode(episode, resp, req, config)
+				return
+			}
+			replayWebSocket(episode, resp, req, config)
+			return
+		}
+	}
+
+	if config.recordsNewEpisodes() {
+		recordWebSocket(resp, req, store, config)
+	} else {
+		denyRequest(resp, req, config)
+	}
+}
+
+// the ws:// or wss:// URL a handshake is sent to, following the same
+// routes as other requests
+func webSocketURL(req *http.Request, config *Config) (*url.URL, error) {
+	var target url.URL
+	if req.URL.IsAbs() {
+		// the forward proxy gets absolute URLs
+		target = *req.URL
+	} else {
+		base := config.TargetURL
+		path := req.URL.Path
+		if route := requestRoute(req); route != nil {
+			base = route.Target
+			if route.StripPrefix {
+				path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, route.PathPrefix), "/")
+			}
+		}
+		if base == "" {
+			return nil, fmt.Errorf("no target url")
+		}
+		baseURL, err := url.Parse(base)
+		if err != nil {
+			return nil, err
+		}
+		target = *baseURL
+		target.Path = strings.TrimSuffix(baseURL.Path, "/") + path
+		target.RawPath = ""
+		target.RawQuery = req.URL.RawQuery
+	}
+
+	switch target.Scheme {
+	case "http", "ws":
+		target.Scheme = "ws"
+	case "https", "wss":
+		target.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+	return &target, nil
+}
+
+// proxies a WebSocket connection, recording the handshake and every
+// message in both directions into an episode once it is closed
+func recordWebSocket(resp http.ResponseWriter, req *http.Request, store *store, config *Config) {
+	target, err := webSocketURL(req, config)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("betamax: cannot proxy websocket: %s", err), 500)
+		return
+	}
+
+	header := http.Header{}
+	for key, values := range req.Header {
+		header[key] = values
+	}
+	for _, key := range webSocketHandshakeHeaders {
+		header.Del(key)
+	}
+
+	recordedRequest := recordRequest(req)
+	replace := store.replacedEpisode(req, config)
+	dialer := websocket.Dialer{
+		Subprotocols:     websocket.Subprotocols(req),
+		HandshakeTimeout: 30 * time.Second,
+	}
+	start := time.Now()
+	upstream, upstreamResp, err := dialer.Dial(target.String(), header)
+	if err != nil {
+		if upstreamResp == nil {
+			upstreamErrorHandler(resp, req, err)
+			return
+		}
+		// a refused handshake is recorded like any other response
+		body, _ := ioutil.ReadAll(upstreamResp.Body)
+		upstreamResp.Body.Close()
+		for key, values := range upstreamResp.Header {
+			resp.Header()[key] = values
+		}
+		resp.WriteHeader(upstreamResp.StatusCode)
+		resp.Write(body)
+		store.writeEpisode(config.Cassette, Episode{
+			Request:    config.Redact.redactRequest(recordedRequest),
+			Response:   config.Redact.redactResponse(RecordedResponse{StatusCode: upstreamResp.StatusCode, Header: upstreamResp.Header, Body: body}),
+			RecordedAt: start.UTC(),
+			Duration:   time.Since(start),
+		}, replace)
+		return
+	}
+
+	responseHeader := http.Header{}
+	if protocol := upstream.Subprotocol(); protocol != "" {
+		responseHeader.Set("Sec-Websocket-Protocol", protocol)
+	}
+	client, err := webSocketUpgrader.Upgrade(resp, req, responseHeader)
+	if err != nil {
+		// the upgrader has answered the client already
+		upstream.Close()
+		return
+	}
+
+	var mu sync.Mutex
+	messages := []WebSocketMessage{}
+	pump := func(from string, src, dst *websocket.Conn, done chan<- struct{}) {
+		defer func() { done <- struct{}{} }()
+		for {
+			kind, data, err := src.ReadMessage()
+			if err != nil {
+				// pass the close on to the other side
+				code, text := websocket.CloseNormalClosure, ""
+				if closeErr, ok := err.(*websocket.CloseError); ok {
+					code, text = closeErr.Code, closeErr.Text
+				}
+				if code == websocket.CloseNoStatusReceived {
+					code = websocket.CloseNormalClosure
+				}
+				dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+				return
+			}
+
+			mu.Lock()
+			messages = append(messages, WebSocketMessage{
+				From:    from,
+				Binary:  kind == websocket.BinaryMessage,
+				Data:    data,
+				Elapsed: time.Since(start),
+			})
+			mu.Unlock()
+
+			if err := dst.WriteMessage(kind, data); err != nil {
+				return
+			}
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go pump(FromClient, client, upstream, done)
+	go pump(FromServer, upstream, client, done)
+
+	// once one side closes, give the other a moment to complete the
+	// closing handshake
+	<-done
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+	client.Close()
+	upstream.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range messages {
+		messages[i].Data = config.Redact.redactWebSocketMessage(messages[i])
+	}
+	store.writeEpisode(config.Cassette, Episode{
+		Request:           config.Redact.redactRequest(recordedRequest),
+		Response:          RecordedResponse{StatusCode: http.StatusSwitchingProtocols, Header: config.Redact.redactHeader(upstreamResp.Header)},
+		RecordedAt:        start.UTC(),
+		Duration:          time.Since(start),
+		WebSocketMessages: messages,
+	}, replace)
+}
+
+// acts as the WebSocket server of a recorded connection: waits for each
+// recorded client message and sends the server messages in order, with
+// their recorded timing. a client sending something other than what was
+// recorded gets the connection closed with a policy violation.
+func replayWebSocket(episode *Episode, resp http.ResponseWriter, req *http.Request, config *Config) {
+	responseHeader := http.Header{}
+	if protocol := episode.Response.Header.Get("Sec-Websocket-Protocol"); protocol != "" {
+		responseHeader.Set("Sec-Websocket-Protocol", protocol)
+	}
+	client, err := webSocketUpgrader.Upgrade(resp, req, responseHeader)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	speed := config.ReplaySpeed
+	if speed <= 0 {
+		speed = 1
+	}
+	closeWith := func(code int, text string) {
+		client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+	}
+
+	// server messages are timed relative to the last client message, as the
+	// client may be slower or faster than it was when recording
+	anchor, anchorElapsed := time.Now(), time.Duration(0)
+	for _, message := range episode.WebSocketMessages {
+		if message.From == FromClient {
+			kind, data, err := client.ReadMessage()
+			if err != nil {
+				return
+			}
+			live := WebSocketMessage{From: FromClient, Binary: kind == websocket.BinaryMessage, Data: data}
+			live.Data = config.Redact.redactWebSocketMessage(live)
+			if live.Binary != message.Binary || !bytes.Equal(live.Data, message.Data) {
+				closeWith(websocket.ClosePolicyViolation, "betamax: unexpected message")
+				return
+			}
+			anchor, anchorElapsed = time.Now(), message.Elapsed
+			continue
+		}
+
+		if wait := time.Until(anchor.Add(time.Duration(float64(message.Elapsed-anchorElapsed) / speed))); wait > 0 {
+			time.Sleep(wait)
+		}
+		kind := websocket.TextMessage
+		if message.Binary {
+			kind = websocket.BinaryMessage
+		}
+		if err := client.WriteMessage(kind, message.Data); err != nil {
+			return
+		}
+	}
+
+	closeWith(websocket.CloseNormalClosure, "")
+	// wait for the client to answer the close
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := client.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// text messages get the same JSON path and body pattern redactions as
+// JSON bodies
+func (r *Redactions) redactWebSocketMessage(message WebSocketMessage) []byte {
+	if message.Binary {
+		return message.Data
+	}
+	return r.redactBody(message.Data, http.Header{"Content-Type": []string{"application/json"}})
+}